@@ -0,0 +1,105 @@
+package godoauth
+
+import "strings"
+
+// userVariable is replaced with the name of the user in the ACL patterns
+const userVariable = "${user}"
+
+// resourceKey returns the key of the resource in the access maps. Registry
+// resources are prefixed with the type, e.g. registry:catalog, repositories
+// are stored by their name alone whatever their class.
+func resourceKey(typ, name string) string {
+	if typ == "registry" {
+		return typ + ":" + name
+	}
+	return name
+}
+
+// resourceType returns the resource type of an access map key
+func resourceType(key string) string {
+	if strings.HasPrefix(key, "registry:") {
+		return "registry"
+	}
+	return "repository"
+}
+
+// matchPattern reports if the repository name matches the ACL pattern.
+// '*' matches any sequence of characters including '/' and '?' matches
+// any single character, everything else has to match literally.
+func matchPattern(pattern, name string) bool {
+	// position of the last '*' and the part of name it consumed so far
+	star, next := -1, 0
+	p, n := 0, 0
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, n
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+		case star >= 0:
+			// let the last '*' consume one more character
+			next++
+			p, n = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// isPattern reports if the ACL entry contains any wildcard
+func isPattern(s string) bool {
+	return strings.ContainsAny(s, "*?")
+}
+
+// morePrecise reports if the pattern a is more specific than b: more
+// literal characters win, then fewer wildcards, then the lexical order
+// so the result is always deterministic
+func morePrecise(a, b string) bool {
+	wa, wb := strings.Count(a, "*")+strings.Count(a, "?"), strings.Count(b, "*")+strings.Count(b, "?")
+	la, lb := len(a)-wa, len(b)-wb
+	if la != lb {
+		return la > lb
+	}
+	if wa != wb {
+		return wa < wb
+	}
+	return a < b
+}
+
+// lookupPriv returns the privileges of the most specific ACL entry matching
+// the resource key. Exact entries always win over patterns, patterns only
+// match resources of the same type. The ${user} variable in the entries is
+// replaced with the username, entries using it never match for anonymous users
+// nor for usernames containing wildcards, which would match other users.
+func lookupPriv(access map[string]Priv, username, name string) Priv {
+	if p, ok := access[name]; ok {
+		return p
+	}
+
+	best, found := "", false
+	var priv Priv
+	for entry, p := range access {
+		if resourceType(entry) != resourceType(name) {
+			continue
+		}
+		pattern := entry
+		if strings.Contains(entry, userVariable) {
+			if username == "" || isPattern(username) {
+				continue
+			}
+			pattern = strings.Replace(entry, userVariable, username, -1)
+		}
+		if pattern == name || (isPattern(pattern) && matchPattern(pattern, name)) {
+			if !found || morePrecise(pattern, best) {
+				best, found, priv = pattern, true, p
+			}
+		}
+	}
+	return priv
+}
@@ -0,0 +1,86 @@
+package godoauth
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		out           bool
+	}{
+		{"foo/bar", "foo/bar", true},
+		{"foo/bar", "foo/baz", false},
+		{"*", "foo", true},
+		{"*", "foo/bar/baz", true},
+		{"*", "", true},
+		{"team-a/*", "team-a/app", true},
+		{"team-a/*", "team-a/app/db", true},
+		{"team-a/*", "team-a", false},
+		{"team-a/*", "team-b/app", false},
+		{"*/app", "team-a/app", true},
+		{"*/app", "team-a/db", false},
+		{"team-?/app", "team-a/app", true},
+		{"team-?/app", "team-ab/app", false},
+		{"*a*b*", "xxaxxbxx", true},
+		{"*a*b", "xxaxxbxx", false},
+		{"a**b", "ab", true},
+	}
+	for _, tt := range tests {
+		if out := matchPattern(tt.pattern, tt.name); out != tt.out {
+			t.Errorf("matchPattern(%q, %q) = %v, expected %v", tt.pattern, tt.name, out, tt.out)
+		}
+	}
+}
+
+func TestLookupPriv(t *testing.T) {
+	access := map[string]Priv{
+		"*":                PrivPull,
+		"team-a/*":         PrivAll,
+		"team-a/secret":    PrivPush,
+		"team-a/secret*":   PrivPull,
+		"team-?/shared":    PrivPush,
+		"${user}/*":        PrivAll,
+		"library/${user}":  PrivPush,
+		"private/*/images": PrivPush,
+	}
+
+	tests := []struct {
+		username, name string
+		out            Priv
+	}{
+		// exact match wins over every pattern
+		{"foo", "team-a/secret", PrivPush},
+		// most literal characters win
+		{"foo", "team-a/secret2", PrivPull},
+		{"foo", "team-a/app", PrivAll},
+		{"foo", "team-b/shared", PrivPush},
+		{"foo", "team-a/shared", PrivPush},
+		{"foo", "private/x/images", PrivPush},
+		{"foo", "other", PrivPull},
+		{"foo", "foo/app", PrivAll},
+		{"foo", "library/foo", PrivPush},
+		{"foo", "library/bar", PrivPull},
+		// ${user} never matches for anonymous users
+		{"", "foo/app", PrivPull},
+		// nor for usernames which would be wildcards in the pattern
+		{"*", "victim/app", PrivPull},
+		{"victi?", "victim/app", PrivPull},
+		{"*", "library/victim", PrivPull},
+	}
+	for _, tt := range tests {
+		if out := lookupPriv(access, tt.username, tt.name); out != tt.out {
+			t.Errorf("lookupPriv(%q, %q) = %v, expected %v", tt.username, tt.name, out, tt.out)
+		}
+	}
+
+	if out := lookupPriv(map[string]Priv{"foo/bar": PrivAll}, "foo", "foo/baz"); out != 0 {
+		t.Errorf("lookupPriv without matching entry = %v, expected 0", out)
+	}
+
+	// the same result regardless of the map iteration order
+	tie := map[string]Priv{"a*c/*": PrivPush, "ab*/*": PrivPull}
+	for i := 0; i < 20; i++ {
+		if out := lookupPriv(tie, "", "abc/d"); out != PrivPush {
+			t.Fatalf("lookupPriv with tie = %v, expected %v", out, PrivPush)
+		}
+	}
+}
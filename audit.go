@@ -0,0 +1,203 @@
+package godoauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// AuditEvent is the audit record of a token request
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Account    string    `json:"account"`
+	Service    string    `json:"service"`
+	Requested  []string  `json:"requested"`
+	Granted    []string  `json:"granted"`
+	JTI        string    `json:"jti,omitempty"`
+	Status     int       `json:"status"`
+	// Reason is the error returned to the client when the request is denied
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditSink records the audit events
+type AuditSink interface {
+	Record(e *AuditEvent) error
+	Close() error
+}
+
+var errAuditQueueFull = errors.New("audit queue full")
+
+// NewAuditSink returns the sink defined in the audit section of the config
+func NewAuditSink(c *Audit) (AuditSink, error) {
+	switch c.Sink {
+	case "file":
+		return &writerSink{w: &lumberjack.Logger{
+			Filename:   c.File.Path,
+			MaxSize:    c.File.MaxSize,
+			MaxBackups: c.File.MaxBackups,
+			MaxAge:     c.File.MaxAge,
+			Compress:   c.File.Compress,
+		}}, nil
+	case "syslog":
+		w, err := dialSyslog(&c.Syslog)
+		if err != nil {
+			return nil, err
+		}
+		return &writerSink{w: w}, nil
+	case "webhook":
+		return newWebhookSink(&c.Webhook), nil
+	default:
+		return nil, fmt.Errorf("unsupported audit sink %s", c.Sink)
+	}
+}
+
+// writerSink writes the events as JSON lines
+type writerSink struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+func (s *writerSink) Record(e *AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+func (s *writerSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
+
+// webhookSink posts the events to the webhook one by one, from a queue so
+// the token requests do not wait for the webhook. Events are dropped when
+// the queue is full.
+type webhookSink struct {
+	url     string
+	timeout time.Duration
+	client  *http.Client
+
+	events chan []byte
+	done   chan struct{}
+}
+
+func newWebhookSink(c *AuditWebhook) *webhookSink {
+	s := &webhookSink{
+		url:     c.URL,
+		timeout: c.Timeout,
+		client:  &http.Client{},
+		events:  make(chan []byte, c.QueueSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *webhookSink) Record(e *AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.events <- b:
+		return nil
+	default:
+		return errAuditQueueFull
+	}
+}
+
+// Close sends the queued events and stops the sink
+func (s *webhookSink) Close() error {
+	close(s.events)
+	<-s.done
+	return nil
+}
+
+func (s *webhookSink) run() {
+	defer close(s.done)
+	for b := range s.events {
+		if err := s.post(b); err != nil {
+			logrus.Errorf("error sending audit event to webhook: %v", err)
+		}
+	}
+}
+
+func (s *webhookSink) post(b []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ctxhttp.Do(ctx, s.client, req)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected webhook response status: %s", resp.Status)
+	}
+	return nil
+}
+
+type auditKeyType int
+
+var auditKey = auditKeyType(0)
+
+func withAuditEvent(ctx context.Context, e *AuditEvent) context.Context {
+	return context.WithValue(ctx, auditKey, e)
+}
+
+// auditEvent returns the audit event of the request, filled in while the
+// request is handled
+func auditEvent(ctx context.Context) *AuditEvent {
+	if e, ok := ctx.Value(auditKey).(*AuditEvent); ok {
+		return e
+	}
+	return &AuditEvent{}
+}
+
+// audit records the event of the request. The granted requests are sampled
+// with the sample_rate, the denied ones are always recorded.
+func (h *TokenAuthHandler) audit(ctx context.Context, rec *statusRecorder) {
+	if h.Audit == nil {
+		return
+	}
+	e := auditEvent(ctx)
+	e.Status = rec.code
+	if e.Requested == nil {
+		e.Requested = []string{}
+	}
+	if e.Granted == nil {
+		e.Granted = []string{}
+	}
+	if rec.code == http.StatusOK {
+		if rate := h.Config.Audit.SampleRate; rate > 0 && rate < 1 && rand.Float64() >= rate {
+			return
+		}
+	} else {
+		e.Reason = rec.reason
+	}
+	if err := h.Audit.Record(e); err != nil {
+		ctxLogger(ctx).Errorf("error recording audit event: %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package godoauth
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func dialSyslog(c *AuditSyslog) (io.WriteCloser, error) {
+	return syslog.Dial(c.Network, c.Address, syslog.LOG_INFO|syslog.LOG_AUTH, c.Tag)
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package godoauth
+
+import (
+	"fmt"
+	"io"
+)
+
+func dialSyslog(c *AuditSyslog) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog audit sink is not supported on this platform")
+}
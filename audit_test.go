@@ -0,0 +1,226 @@
+package godoauth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAuditSink keeps the recorded events in memory
+type fakeAuditSink struct {
+	mu     sync.Mutex
+	events []*AuditEvent
+}
+
+func (s *fakeAuditSink) Record(e *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *fakeAuditSink) Close() error {
+	return nil
+}
+
+func (s *fakeAuditSink) last() *AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.events) == 0 {
+		return nil
+	}
+	return s.events[len(s.events)-1]
+}
+
+func newTestAuditHandler(t *testing.T, dir string) (*TokenAuthHandler, *fakeAuditSink) {
+	sink := &fakeAuditSink{}
+	return &TokenAuthHandler{
+		Config: newTestConfig(t, dir),
+		Backend: &fakeBackend{
+			users: map[string]*UserInfo{
+				"foo": {Username: "foo", Password: "bar", Access: map[string]Priv{"foo/bar": PrivAll, "foo/baz": PrivPull}},
+			},
+		},
+		Audit: sink,
+	}, sink
+}
+
+func TestAuditEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, sink := newTestAuditHandler(t, dir)
+
+	tests := []struct {
+		query      string
+		user, pass string
+		expected   AuditEvent
+	}{
+		{
+			"service=registry&scope=repository:foo/baz:push,pull", "foo", "bar",
+			AuditEvent{Account: "foo", Service: "registry", Requested: []string{"repository:foo/baz:push,pull"}, Granted: []string{"repository:foo/baz:pull"}, Status: http.StatusOK},
+		},
+		{
+			"service=registry&scope=repository:foo/bar:pull", "foo", "wrong",
+			AuditEvent{Account: "foo", Service: "registry", Requested: []string{"repository:foo/bar:pull"}, Granted: []string{}, Status: http.StatusForbidden, Reason: "User has no access"},
+		},
+		{
+			"scope=repository:foo/bar:pull", "foo", "bar",
+			AuditEvent{Requested: []string{}, Granted: []string{}, Status: http.StatusBadRequest, Reason: HTTPBadRequest("missing service from the request.").Error()},
+		},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/auth?"+tt.query, nil)
+		req.RemoteAddr = "192.0.2.1:41234"
+		req.SetBasicAuth(tt.user, tt.pass)
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, req)
+
+		e := sink.last()
+		if e == nil {
+			t.Fatalf("GET /auth?%s: no audit event recorded", tt.query)
+		}
+		if e.RemoteAddr != "192.0.2.1:41234" || time.Since(e.Time) > time.Minute {
+			t.Errorf("GET /auth?%s: unexpected remote addr %s or time %s", tt.query, e.RemoteAddr, e.Time)
+		}
+		if tt.expected.Status == http.StatusOK {
+			var token tokenResponse
+			if err := json.Unmarshal(response.Body.Bytes(), &token); err != nil {
+				t.Fatal(err)
+			}
+			claims := tokenClaims(t, token.Token)
+			if e.JTI == "" || e.JTI != claims["jti"] {
+				t.Errorf("GET /auth?%s: audit jti %q, token jti %v", tt.query, e.JTI, claims["jti"])
+			}
+		} else if e.JTI != "" {
+			t.Errorf("GET /auth?%s: unexpected jti %q for a denied request", tt.query, e.JTI)
+		}
+		got := *e
+		got.Time, got.RemoteAddr, got.JTI = time.Time{}, "", ""
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("GET /auth?%s: audit event %+v, expected %+v", tt.query, got, tt.expected)
+		}
+	}
+}
+
+func TestAuditSampling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, sink := newTestAuditHandler(t, dir)
+	h.Config.Audit.SampleRate = 1e-9
+
+	for _, pass := range []string{"bar", "wrong"} {
+		req, _ := http.NewRequest("GET", "/auth?service=registry&scope=repository:foo/bar:pull", nil)
+		req.SetBasicAuth("foo", pass)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if len(sink.events) != 1 || sink.events[0].Status != http.StatusForbidden {
+		t.Errorf("expected only the denied request to be recorded, got %d events", len(sink.events))
+	}
+}
+
+func TestAuditFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	sink, err := NewAuditSink(&Audit{Sink: "file", File: AuditFile{Path: path, MaxSize: 1}})
+	if err != nil {
+		t.Fatalf("NewAuditSink() failed: %v", err)
+	}
+	for _, account := range []string{"foo", "bar"} {
+		if err := sink.Record(&AuditEvent{Account: account, Service: "registry"}); err != nil {
+			t.Fatalf("Record() failed: %v", err)
+		}
+	}
+	sink.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"account":"bar"`) {
+		t.Errorf("unexpected audit file content %s", b)
+	}
+}
+
+func TestAuditSyslogSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := NewAuditSink(&Audit{Sink: "syslog", Syslog: AuditSyslog{Network: "udp", Address: conn.LocalAddr().String(), Tag: "godoauth"}})
+	if err != nil {
+		t.Fatalf("NewAuditSink() failed: %v", err)
+	}
+	defer sink.Close()
+	if err := sink.Record(&AuditEvent{Account: "foo", Service: "registry"}); err != nil {
+		t.Fatalf("Record() failed: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// priority auth.info and the tag precede the event
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<38>") || !strings.Contains(msg, "godoauth") || !strings.Contains(msg, `"account":"foo"`) {
+		t.Errorf("unexpected syslog message %q", msg)
+	}
+}
+
+func TestAuditWebhookSink(t *testing.T) {
+	var mu sync.Mutex
+	var accounts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e AuditEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		accounts = append(accounts, e.Account)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	sink, err := NewAuditSink(&Audit{Sink: "webhook", Webhook: AuditWebhook{URL: server.URL, Timeout: time.Second, QueueSize: 10}})
+	if err != nil {
+		t.Fatalf("NewAuditSink() failed: %v", err)
+	}
+	for _, account := range []string{"foo", "bar"} {
+		if err := sink.Record(&AuditEvent{Account: account}); err != nil {
+			t.Fatalf("Record() failed: %v", err)
+		}
+	}
+	// Close waits for the queued events
+	sink.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(accounts, ",") != "foo,bar" {
+		t.Errorf("unexpected events received by the webhook: %v", accounts)
+	}
+}
@@ -1,9 +1,119 @@
 package godoauth
 
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
 // UserInfo generic struct holding user data info
 // generic to the backend user
 type UserInfo struct {
 	Username string
 	Password string
 	Access   map[string]Priv
+	// Groups the user is member of
+	Groups []string
+	// GroupAccess holds the access of each group of the user
+	GroupAccess map[string]map[string]Priv
+}
+
+// Priv returns the privileges of the user for the resource key, which is the
+// repository name or <type>:<name> for other resources. It is the union
+// of the user and group grants, inside each of them the ACL entries may contain
+// wildcards in which case the most specific one wins.
+func (u *UserInfo) Priv(name string) Priv {
+	p := lookupPriv(u.Access, u.Username, name)
+	for _, access := range u.GroupAccess {
+		p |= lookupPriv(access, u.Username, name)
+	}
+	return p
+}
+
+// UserBackend is the interface every storage backend has to implement
+// so it can be used by the TokenAuthHandler to authenticate users.
+// Errors returned by the backend are expected to be *HTTPAuthError.
+type UserBackend interface {
+	// RetrieveUser looks up the account in the namespace of the service.
+	// Unknown accounts are reported with ErrForbidden.
+	RetrieveUser(ctx context.Context, service, account string) (*UserInfo, error)
+
+	// Authenticate reports if the password is valid for the user.
+	Authenticate(ctx context.Context, user *UserInfo, password string) (bool, error)
+
+	// Access returns the privileges the user has for each repository.
+	Access(ctx context.Context, user *UserInfo) (map[string]Priv, error)
+}
+
+// GroupBackend is implemented by the backends which can also store groups
+type GroupBackend interface {
+	// RetrieveGroup returns the access of the group in the namespace of
+	// the service. Unknown groups have no access.
+	RetrieveGroup(ctx context.Context, service, group string) (map[string]Priv, error)
+}
+
+// CacheBackend is implemented by the backends caching the users, it lets
+// a change of a user be applied before the cached entry expires
+type CacheBackend interface {
+	// Invalidate drops the account of the service from the cache
+	Invalidate(service, account string)
+	// Purge drops all the cached users
+	Purge()
+}
+
+// RefreshBackend is implemented by the backends whose RetrieveUser does not
+// look the user up in the storage. The refresh token grant, which has no
+// password to check, uses RefreshUser instead to check the user still exists
+// and to resolve its current access.
+type RefreshBackend interface {
+	// RefreshUser looks up the account and its access without password.
+	// Unknown accounts are reported with ErrForbidden.
+	RefreshUser(ctx context.Context, service, account string) (*UserInfo, error)
+}
+
+// NewUserBackend returns the UserBackend defined in the storage section
+// of the config.
+func NewUserBackend(c *Config) (UserBackend, error) {
+	switch {
+	case c.Storage.Vault.enabled():
+		b, err := NewVaultClient(&c.Storage.Vault)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case c.Storage.Htpasswd.Path != "":
+		b, err := NewHtpasswdBackend(&c.Storage.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case c.Storage.LDAP.URL != "":
+		b, err := NewLDAPBackend(&c.Storage.LDAP)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("no storage backend defined")
+	}
+}
+
+// parseAccess decodes the access list in the text-form used by the backends:
+// <type>:<name>:<actions>;<type>:<name>:<actions>;...
+func parseAccess(access string) (map[string]Priv, error) {
+	accessMap := make(map[string]Priv)
+	if access == "" {
+		return accessMap, nil
+	}
+	semiColonSplit := strings.Split(access, ";")
+	for _, x := range semiColonSplit {
+		xx := strings.Split(x, ":")
+		if len(xx) != 3 {
+			return nil, NewHTTPError("Wrong access format", http.StatusInternalServerError)
+		}
+		accessMap[resourceKey(xx[0], xx[1])] = accessPriv(xx[0], xx[2])
+	}
+	return accessMap, nil
 }
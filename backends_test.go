@@ -0,0 +1,62 @@
+package godoauth
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAccess(t *testing.T) {
+	access, err := parseAccess("repository:foo/bar:*;repository:team-a/*:pull;registry:catalog:*;repository(plugin):vieux/sshfs:pull")
+	expected := map[string]Priv{"foo/bar": PrivPush | PrivPull, "team-a/*": PrivPull, "registry:catalog": PrivAll, "vieux/sshfs": PrivPull}
+	if err != nil || !reflect.DeepEqual(access, expected) {
+		t.Errorf("parseAccess() = %v, %v, expected %v", access, err, expected)
+	}
+
+	// "*" keeps meaning push and pull on repositories, delete is only granted
+	// when listed
+	access, err = parseAccess("repository:foo/*:*;repository:foo/bar:*,delete;repository:foo/baz:pull,delete")
+	expected = map[string]Priv{"foo/*": PrivPush | PrivPull, "foo/bar": PrivAll, "foo/baz": PrivPull | PrivDelete}
+	if err != nil || !reflect.DeepEqual(access, expected) {
+		t.Errorf("parseAccess() = %v, %v, expected %v", access, err, expected)
+	}
+
+	access, err = parseAccess("")
+	if err != nil || len(access) != 0 {
+		t.Errorf("parseAccess(\"\") = %v, %v, expected empty access", access, err)
+	}
+
+	if _, err := parseAccess("repository:foo/bar:*;foo/baz:pull"); err == nil {
+		t.Errorf("expected error for malformed access")
+	}
+}
+
+func TestUserInfoPriv(t *testing.T) {
+	user := &UserInfo{
+		Username: "foo",
+		Access: map[string]Priv{
+			"*":         PrivPull,
+			"${user}/*": PrivAll,
+		},
+		Groups: []string{"team-a", "team-b"},
+		GroupAccess: map[string]map[string]Priv{
+			"team-a": {"team-a/*": PrivPush},
+			"team-b": {"team-a/secret": 0, "shared/*": PrivPush},
+		},
+	}
+
+	tests := []struct {
+		name string
+		out  Priv
+	}{
+		{"foo/app", PrivAll},
+		{"team-a/app", PrivPush | PrivPull},
+		{"team-a/secret", PrivPush | PrivPull},
+		{"shared/db", PrivPush | PrivPull},
+		{"other", PrivPull},
+	}
+	for _, tt := range tests {
+		if out := user.Priv(tt.name); out != tt.out {
+			t.Errorf("Priv(%q) = %v, expected %v", tt.name, out, tt.out)
+		}
+	}
+}
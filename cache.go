@@ -0,0 +1,201 @@
+package godoauth
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/singleflight"
+)
+
+// userCache keeps the users and the group access retrieved from Vault for a
+// while, so the several /auth requests of a docker pull need a single lookup.
+// Unknown users are cached too, for a shorter time. The least recently used
+// entries are evicted once the cache is full.
+type userCache struct {
+	config VaultCache
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	lookups singleflight.Group
+}
+
+type cacheEntry struct {
+	key string
+	// value is the *UserInfo or the group access, nil for an unknown user
+	value interface{}
+	// expires is when the user is looked up again, until stale the entry
+	// is still used when the lookup fails
+	expires time.Time
+	stale   time.Time
+}
+
+func newUserCache(c VaultCache) *userCache {
+	return &userCache{
+		config:  c,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// the kinds of the cached entries
+const (
+	cachedUser  = "user"
+	cachedGroup = "group"
+)
+
+// cacheKey joins the kind, the service and the name with a NUL byte, the
+// service and the name come from the request and may contain a slash, e.g.
+// a/b and c or a and b/c
+func cacheKey(kind, service, name string) string {
+	return kind + "\x00" + service + "\x00" + name
+}
+
+// get returns the cached user or looks it up, concurrent lookups of the same
+// user share a single call. When the lookup fails with anything else than
+// ErrForbidden, a user cached less than stale_ttl ago is returned instead.
+func (c *userCache) get(ctx context.Context, service, account string, lookup func() (*UserInfo, error)) (*UserInfo, error) {
+	v, err := c.lookup(ctx, cacheKey(cachedUser, service, account), "user "+account, func() (interface{}, error) {
+		user, err := lookup()
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*UserInfo).copy(), nil
+}
+
+// getGroup returns the cached access of the group or looks it up like get.
+// The access of an unknown group is nil and cached as well. The returned map
+// is shared and must not be changed.
+func (c *userCache) getGroup(ctx context.Context, service, group string, lookup func() (map[string]Priv, error)) (map[string]Priv, error) {
+	v, err := c.lookup(ctx, cacheKey(cachedGroup, service, group), "group "+group, func() (interface{}, error) {
+		access, err := lookup()
+		if err != nil {
+			return nil, err
+		}
+		// a nil access is still a non-nil value
+		return access, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]Priv), nil
+}
+
+// lookup returns the cached value of the key or calls lookup, see get
+func (c *userCache) lookup(ctx context.Context, key, name string, lookup func() (interface{}, error)) (interface{}, error) {
+	entry := c.load(key)
+	if entry != nil && c.now().Before(entry.expires) {
+		if entry.value == nil {
+			cacheLookups.WithLabelValues("negative_hit").Inc()
+			return nil, ErrForbidden
+		}
+		cacheLookups.WithLabelValues("hit").Inc()
+		return entry.value, nil
+	}
+
+	v, err, _ := c.lookups.Do(key, func() (interface{}, error) {
+		value, err := lookup()
+		switch err {
+		case nil:
+			c.store(key, value, c.config.TTL)
+		case ErrForbidden:
+			c.store(key, nil, c.config.NegativeTTL)
+		}
+		return value, err
+	})
+	if err == nil {
+		cacheLookups.WithLabelValues("miss").Inc()
+		return v, nil
+	}
+	if err != ErrForbidden && entry != nil && entry.value != nil {
+		ctxLogger(ctx).Warnf("vault lookup of %s failed, using the cached one", name)
+		cacheLookups.WithLabelValues("stale").Inc()
+		return entry.value, nil
+	}
+	cacheLookups.WithLabelValues("miss").Inc()
+	return nil, err
+}
+
+// load returns the entry of the key, dropping it once it is stale
+func (c *userCache) load(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.stale) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+func (c *userCache) store(key string, value interface{}, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	now := c.now()
+	entry := &cacheEntry{key: key, value: value, expires: now.Add(ttl), stale: now.Add(ttl)}
+	if value != nil && c.config.StaleTTL > 0 {
+		entry.stale = entry.expires.Add(c.config.StaleTTL)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.config.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate drops the user, the next request looks it up again
+func (c *userCache) invalidate(service, account string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(cachedUser, service, account)
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// purge drops all the users and groups
+func (c *userCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// copy returns a copy of the user the handler can add the groups to without
+// changing the cached one
+func (u *UserInfo) copy() *UserInfo {
+	user := *u
+	user.Groups = append([]string(nil), u.Groups...)
+	user.GroupAccess = nil
+	return &user
+}
@@ -0,0 +1,316 @@
+package godoauth
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeLookup counts the lookups and returns the users by account
+type fakeLookup struct {
+	calls int64
+	users map[string]*UserInfo
+	err   error
+}
+
+func (l *fakeLookup) lookup(account string) func() (*UserInfo, error) {
+	return func() (*UserInfo, error) {
+		atomic.AddInt64(&l.calls, 1)
+		if l.err != nil {
+			return nil, l.err
+		}
+		user, ok := l.users[account]
+		if !ok {
+			return nil, ErrForbidden
+		}
+		return user, nil
+	}
+}
+
+func newTestCache(size int) (*userCache, *time.Time) {
+	now := time.Now()
+	c := newUserCache(VaultCache{Size: size, TTL: time.Minute, NegativeTTL: 10 * time.Second, StaleTTL: 5 * time.Minute})
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestUserCache(t *testing.T) {
+	c, now := newTestCache(10)
+	ctx := context.Background()
+	l := &fakeLookup{users: map[string]*UserInfo{
+		"foo": {Username: "foo", Password: "bar", Groups: []string{"team-a"}},
+	}}
+
+	for i := 0; i < 3; i++ {
+		user, err := c.get(ctx, "registry", "foo", l.lookup("foo"))
+		if err != nil || user.Username != "foo" {
+			t.Fatalf("get(foo) = %v, %v", user, err)
+		}
+		// the handler adds the groups of the config file to the user
+		user.Groups = append(user.Groups, "admins")
+		user.GroupAccess = map[string]map[string]Priv{"admins": {"*": PrivAll}}
+	}
+	if l.calls != 1 {
+		t.Errorf("Expected 1 lookup, but received %d", l.calls)
+	}
+	if cached := l.users["foo"]; !reflect.DeepEqual(cached.Groups, []string{"team-a"}) || cached.GroupAccess != nil {
+		t.Errorf("cached user modified: %+v", cached)
+	}
+
+	// unknown users are cached for the negative TTL
+	for i := 0; i < 2; i++ {
+		if _, err := c.get(ctx, "registry", "bar", l.lookup("bar")); err != ErrForbidden {
+			t.Errorf("Expected ErrForbidden for unknown user, but received %v", err)
+		}
+	}
+	if l.calls != 2 {
+		t.Errorf("Expected 2 lookups, but received %d", l.calls)
+	}
+	*now = now.Add(20 * time.Second)
+	c.get(ctx, "registry", "bar", l.lookup("bar"))
+	if l.calls != 3 {
+		t.Errorf("Expected the unknown user to expire, but received %d lookups", l.calls)
+	}
+
+	// the same account of another service is another user
+	c.get(ctx, "other", "foo", l.lookup("foo"))
+	if l.calls != 4 {
+		t.Errorf("Expected a lookup for another service, but received %d lookups", l.calls)
+	}
+
+	*now = now.Add(time.Minute)
+	c.get(ctx, "registry", "foo", l.lookup("foo"))
+	if l.calls != 5 {
+		t.Errorf("Expected the user to expire, but received %d lookups", l.calls)
+	}
+
+	c.invalidate("registry", "foo")
+	c.get(ctx, "registry", "foo", l.lookup("foo"))
+	if l.calls != 6 {
+		t.Errorf("Expected a lookup after invalidate, but received %d lookups", l.calls)
+	}
+}
+
+func TestUserCacheStale(t *testing.T) {
+	c, now := newTestCache(10)
+	ctx := context.Background()
+	l := &fakeLookup{users: map[string]*UserInfo{"foo": {Username: "foo"}}}
+
+	c.get(ctx, "registry", "foo", l.lookup("foo"))
+	c.get(ctx, "registry", "bar", l.lookup("bar"))
+
+	// Vault cannot be reached
+	l.err = ErrInternal
+	*now = now.Add(2 * time.Minute)
+	if user, err := c.get(ctx, "registry", "foo", l.lookup("foo")); err != nil || user.Username != "foo" {
+		t.Errorf("Expected the stale user, but received %v, %v", user, err)
+	}
+	if _, err := c.get(ctx, "registry", "bar", l.lookup("bar")); err != ErrInternal {
+		t.Errorf("Expected ErrInternal for the unknown user, but received %v", err)
+	}
+
+	*now = now.Add(5 * time.Minute)
+	if _, err := c.get(ctx, "registry", "foo", l.lookup("foo")); err != ErrInternal {
+		t.Errorf("Expected ErrInternal after stale_ttl, but received %v", err)
+	}
+
+	// a user removed from Vault is not used anymore
+	l.err = nil
+	c.get(ctx, "registry", "foo", l.lookup("foo"))
+	delete(l.users, "foo")
+	*now = now.Add(2 * time.Minute)
+	if _, err := c.get(ctx, "registry", "foo", l.lookup("foo")); err != ErrForbidden {
+		t.Errorf("Expected ErrForbidden for the removed user, but received %v", err)
+	}
+}
+
+func TestUserCacheEviction(t *testing.T) {
+	c, _ := newTestCache(2)
+	ctx := context.Background()
+	l := &fakeLookup{users: map[string]*UserInfo{"a": {}, "b": {}, "c": {}}}
+
+	c.get(ctx, "registry", "a", l.lookup("a"))
+	c.get(ctx, "registry", "b", l.lookup("b"))
+	c.get(ctx, "registry", "a", l.lookup("a"))
+	// b is the least recently used
+	c.get(ctx, "registry", "c", l.lookup("c"))
+	if l.calls != 3 {
+		t.Fatalf("Expected 3 lookups, but received %d", l.calls)
+	}
+
+	c.get(ctx, "registry", "a", l.lookup("a"))
+	c.get(ctx, "registry", "c", l.lookup("c"))
+	if l.calls != 3 {
+		t.Errorf("Expected a and c to be cached, but received %d lookups", l.calls)
+	}
+	c.get(ctx, "registry", "b", l.lookup("b"))
+	if l.calls != 4 {
+		t.Errorf("Expected b to be evicted, but received %d lookups", l.calls)
+	}
+}
+
+func TestUserCacheSingleflight(t *testing.T) {
+	c, _ := newTestCache(10)
+	ctx := context.Background()
+
+	var calls int64
+	started := make(chan struct{})
+	release := make(chan struct{})
+	lookup := func() (*UserInfo, error) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return &UserInfo{Username: "foo"}, nil
+	}
+
+	var wg sync.WaitGroup
+	get := func() {
+		defer wg.Done()
+		if user, err := c.get(ctx, "registry", "foo", lookup); err != nil || user.Username != "foo" {
+			t.Errorf("get(foo) = %v, %v", user, err)
+		}
+	}
+	wg.Add(1)
+	go get()
+	<-started
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go get()
+	}
+	// let the other lookups join the first one
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("Expected 1 lookup, but received %d", calls)
+	}
+}
+
+func TestUserCacheSlashes(t *testing.T) {
+	c, _ := newTestCache(10)
+	ctx := context.Background()
+	l := &fakeLookup{users: map[string]*UserInfo{"b/c": {Username: "b/c"}}}
+
+	// service a/b with account c is not the account b/c of service a
+	c.get(ctx, "a", "b/c", l.lookup("b/c"))
+	if user, err := c.get(ctx, "a/b", "c", l.lookup("c")); err != ErrForbidden {
+		t.Errorf("Expected ErrForbidden for account c of a/b, but received %v, %v", user, err)
+	}
+	if l.calls != 2 {
+		t.Errorf("Expected 2 lookups, but received %d", l.calls)
+	}
+}
+
+func TestVaultCache(t *testing.T) {
+	var requests int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if r.URL.Path != "/v1/registry/foo" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(vaultReturnV_1))
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	p, _ := strconv.Atoi(port)
+	v, err := NewVaultClient(&Vault{
+		Proto:   "http",
+		Host:    host,
+		Port:    p,
+		Timeout: time.Second,
+		Cache:   VaultCache{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+			t.Fatalf("RetrieveUser() failed: %v", err)
+		}
+		if _, err := v.RetrieveUser(ctx, "registry", "unknown"); err != ErrForbidden {
+			t.Fatalf("Expected ErrForbidden for unknown user, but received %v", err)
+		}
+	}
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Errorf("Expected 2 requests to Vault, but received %d", n)
+	}
+
+	v.Invalidate("registry", "foo")
+	v.RetrieveUser(ctx, "registry", "foo")
+	if n := atomic.LoadInt64(&requests); n != 3 {
+		t.Errorf("Expected 3 requests to Vault after Invalidate, but received %d", n)
+	}
+
+	var b UserBackend = v
+	b.(CacheBackend).Purge()
+	v.RetrieveUser(ctx, "registry", "foo")
+	v.RetrieveUser(ctx, "registry", "unknown")
+	if n := atomic.LoadInt64(&requests); n != 5 {
+		t.Errorf("Expected 5 requests to Vault after Purge, but received %d", n)
+	}
+}
+
+func TestVaultCacheGroups(t *testing.T) {
+	var requests, failing int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt64(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		atomic.AddInt64(&requests, 1)
+		if r.URL.Path != "/v1/registry/groups/team-a" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data":{"access":"repository:team-a/*:pull"}}`))
+	}))
+	defer ts.Close()
+
+	v, err := NewVaultClient(&Vault{
+		Addresses: []string{ts.URL},
+		Timeout:   time.Second,
+		Cache:     VaultCache{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute, StaleTTL: 5 * time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	v.cache.now = func() time.Time { return now }
+	ctx := context.Background()
+	expected := map[string]Priv{"team-a/*": PrivPull}
+
+	for i := 0; i < 3; i++ {
+		if access, err := v.RetrieveGroup(ctx, "registry", "team-a"); err != nil || !reflect.DeepEqual(access, expected) {
+			t.Fatalf("RetrieveGroup(team-a) = %v, %v, expected %v", access, err, expected)
+		}
+		if access, err := v.RetrieveGroup(ctx, "registry", "unknown"); err != nil || access != nil {
+			t.Fatalf("RetrieveGroup(unknown) = %v, %v, expected no access", access, err)
+		}
+	}
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Errorf("Expected 2 requests to Vault, but received %d", n)
+	}
+
+	// the expired group is still used while Vault fails
+	atomic.StoreInt64(&failing, 1)
+	now = now.Add(2 * time.Minute)
+	if access, err := v.RetrieveGroup(ctx, "registry", "team-a"); err != nil || !reflect.DeepEqual(access, expected) {
+		t.Errorf("RetrieveGroup(team-a) with Vault failing = %v, %v, expected %v", access, err, expected)
+	}
+}
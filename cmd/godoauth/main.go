@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"gopkg.in/tylerb/graceful.v1"
 
 	"github.com/n1tr0g/godoauth"
@@ -49,14 +52,51 @@ func main() {
 		os.Exit(1)
 	}
 
+	logger, err := godoauth.NewLogger(&config.Log)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error while creating logger: ", err)
+		os.Exit(1)
+	}
+	// the backends log to the standard logger outside of the requests
+	logrus.SetOutput(logger.Out)
+	logrus.SetFormatter(logger.Formatter)
+	logrus.SetLevel(logger.Level)
+
 	if err := config.LoadCerts(); err != nil {
 		fmt.Fprintln(os.Stderr, "error while loading/veryfing certs: ", err)
+		os.Exit(1)
+	}
+
+	backend, err := godoauth.NewUserBackend(&config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error while creating storage backend: ", err)
+		os.Exit(1)
 	}
 
 	fmt.Printf("Starting %s version: %s\n", name, version)
 
 	authHandler := &godoauth.TokenAuthHandler{
-		Config: &config,
+		Config:  &config,
+		Backend: backend,
+		Keys:    godoauth.NewKeyring(&config.Token),
+		Logger:  logger,
+	}
+	if config.Audit.Sink != "" {
+		sink, err := godoauth.NewAuditSink(&config.Audit)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error while creating audit sink: ", err)
+			os.Exit(1)
+		}
+		defer sink.Close()
+		authHandler.Audit = sink
+	}
+	if config.Token.RefreshExpiration > 0 {
+		authHandler.RefreshTokens = godoauth.NewRefreshTokenStore(time.Duration(config.Token.RefreshExpiration) * time.Second)
+	}
+
+	go rotateOnHangup(authHandler.Keys, logger)
+	if cache, ok := backend.(godoauth.CacheBackend); ok {
+		go purgeOnUser1(cache, logger)
 	}
 
 	server := &graceful.Server{
@@ -74,3 +114,36 @@ func main() {
 	}
 	server.ListenAndServe()
 }
+
+// rotateOnHangup reloads the token keys from the config file on SIGHUP. A new
+// signing key is published before it signs, the previous one stays published
+// until the tokens it signed expire. The other settings need a restart to be
+// applied.
+func rotateOnHangup(keys *godoauth.Keyring, logger *logrus.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		var config godoauth.Config
+		if err := config.LoadFromFile(confFile); err != nil {
+			logger.Errorf("error parsing config file: %v", err)
+			continue
+		}
+		if err := config.LoadCerts(); err != nil {
+			logger.Errorf("error while loading/veryfing certs: %v", err)
+			continue
+		}
+		keys.Rotate(&config.Token)
+		logger.Info("token signing key reloaded, it signs once the key set caches have expired")
+	}
+}
+
+// purgeOnUser1 empties the user cache on SIGUSR1, so the changes of the users
+// in the storage are applied without waiting for the cached entries to expire.
+func purgeOnUser1(cache godoauth.CacheBackend, logger *logrus.Logger) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	for range usr1 {
+		cache.Purge()
+		logger.Info("user cache purged")
+	}
+}
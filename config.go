@@ -3,35 +3,59 @@ package godoauth
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/docker/libtrust"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Version string     `yaml:"version,omitempty"`
-	Log     Log        `yaml:"log,omitempty"`
-	Storage Storage    `yaml:"storage,omitempty"`
-	HTTP    ServerConf `yaml:"http"`
-	Token   Token      `yaml:"token"`
+	Version   string           `yaml:"version,omitempty"`
+	Log       Log              `yaml:"log,omitempty"`
+	Storage   Storage          `yaml:"storage,omitempty"`
+	HTTP      ServerConf       `yaml:"http"`
+	Token     Token            `yaml:"token"`
+	Anonymous Anonymous        `yaml:"anonymous,omitempty"`
+	Groups    map[string]Group `yaml:"groups,omitempty"`
+	Audit     Audit            `yaml:"audit,omitempty"`
+	Metrics   Metrics          `yaml:"metrics,omitempty"`
 }
 
 type Log struct {
-	Level string `yaml:"level,omitempty"`
-	File  string `yaml:"file,omitempty"`
+	Level  string `yaml:"level,omitempty"`
+	Format string `yaml:"format,omitempty"`
+	File   string `yaml:"file,omitempty"`
 }
 
 type Storage struct {
-	Vault Vault `yaml:"vault"`
+	Vault    Vault    `yaml:"vault"`
+	Htpasswd Htpasswd `yaml:"htpasswd,omitempty"`
+	LDAP     LDAP     `yaml:"ldap,omitempty"`
+}
+
+// backends returns the names of all storage backends defined
+func (s Storage) backends() []string {
+	var names []string
+	if s.Vault.enabled() {
+		names = append(names, "vault")
+	}
+	if s.Htpasswd.Path != "" {
+		names = append(names, "htpasswd")
+	}
+	if s.LDAP.URL != "" {
+		names = append(names, "ldap")
+	}
+	return names
 }
 
 type Vault struct {
@@ -41,12 +65,186 @@ type Vault struct {
 	Proto     string        `yaml:"proto"`
 	Pool      int           `yaml:"pool,omitempty"`
 	Timeout   time.Duration `yaml:"timeout,omitempty"`
+	// IdleTimeout closes the pooled connections unused for that long
+	IdleTimeout time.Duration `yaml:"idle_timeout,omitempty"`
+	// Addresses are the URLs of the servers of a Vault cluster, used
+	// instead of Proto, Host and Port
+	Addresses []string `yaml:"addresses,omitempty"`
+	// Retries is how many more times the servers are tried when none of
+	// them answered
+	Retries int `yaml:"retries,omitempty"`
+	// HealthCheckInterval is how long a failed server is avoided before
+	// its sys/health is checked again
+	HealthCheckInterval time.Duration `yaml:"health_check_interval,omitempty"`
+	// PlaintextPasswords accepts passwords stored in cleartext, only
+	// meant for the migration of existing installations
+	PlaintextPasswords bool `yaml:"legacy_plaintext_passwords,omitempty"`
+	// KVVersion is the version of the KV secrets engine mounted under the
+	// service name, 1 (generic) or 2
+	KVVersion int `yaml:"kv_version,omitempty"`
+	// SecretVersion pins the KV version 2 secrets to a version, 0 reads
+	// the latest one
+	SecretVersion int `yaml:"secret_version,omitempty"`
+	// Auth is how godoauth logs in to Vault, by default with AuthToken
+	Auth VaultAuth `yaml:"auth,omitempty"`
+	TLS  VaultTLS  `yaml:"tls,omitempty"`
+	// Cache keeps the users retrieved from Vault in memory
+	Cache VaultCache `yaml:"cache,omitempty"`
+}
+
+// VaultCache is the size and lifetime of the cached Vault users, the cache
+// is disabled when Size is 0
+type VaultCache struct {
+	Size int           `yaml:"size,omitempty"`
+	TTL  time.Duration `yaml:"ttl,omitempty"`
+	// NegativeTTL is how long unknown users are cached
+	NegativeTTL time.Duration `yaml:"negative_ttl,omitempty"`
+	// StaleTTL is how long after the TTL a user is still used while Vault
+	// cannot be reached
+	StaleTTL time.Duration `yaml:"stale_ttl,omitempty"`
+}
+
+// VaultTLS is the TLS client configuration of the https connection to Vault
+type VaultTLS struct {
+	// CACert is the PEM bundle verifying the Vault server instead of the
+	// system roots
+	CACert     string `yaml:"ca_cert,omitempty"`
+	ClientCert string `yaml:"client_cert,omitempty"`
+	ClientKey  string `yaml:"client_key,omitempty"`
+	ServerName string `yaml:"server_name,omitempty"`
+	// MinVersion is the lowest TLS version accepted, 1.0 to 1.3
+	MinVersion string `yaml:"min_version,omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// config loads the certificates and returns the tls.Config of the Vault
+// connection
+func (t VaultTLS) config() (*tls.Config, error) {
+	config := &tls.Config{ServerName: t.ServerName}
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported Vault TLS min_version %s", t.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if t.CACert != "" {
+		pem, err := ioutil.ReadFile(t.CACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CACert)
+		}
+	}
+
+	if t.ClientCert != "" || t.ClientKey != "" {
+		if t.ClientCert == "" || t.ClientKey == "" {
+			return nil, fmt.Errorf("Vault TLS client_cert and client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// VaultAuth is the Vault auth method used to get the token of godoauth
+type VaultAuth struct {
+	// Method is one of token, token_file, approle or kubernetes
+	Method string `yaml:"method,omitempty"`
+	// Mount is the path the auth method is mounted at, defaults to its name
+	Mount        string `yaml:"mount,omitempty"`
+	TokenFile    string `yaml:"token_file,omitempty"`
+	RoleID       string `yaml:"role_id,omitempty"`
+	SecretID     string `yaml:"secret_id,omitempty"`
+	SecretIDFile string `yaml:"secret_id_file,omitempty"`
+	Role         string `yaml:"role,omitempty"`
+	JWTFile      string `yaml:"jwt_file,omitempty"`
+}
+
+// kubernetesJWTFile is where Kubernetes mounts the service account token
+const kubernetesJWTFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// validate checks the settings of the auth method and sets the defaults
+func (a *VaultAuth) validate() error {
+	switch a.Method {
+	case "", "token":
+		a.Method = "token"
+	case "token_file":
+		if a.TokenFile == "" {
+			return fmt.Errorf("Missing token_file for the Vault token_file auth method")
+		}
+	case "approle":
+		if a.RoleID == "" || (a.SecretID == "" && a.SecretIDFile == "") {
+			return fmt.Errorf("Missing role_id or secret_id for the Vault approle auth method")
+		}
+	case "kubernetes":
+		if a.Role == "" {
+			return fmt.Errorf("Missing role for the Vault kubernetes auth method")
+		}
+		if a.JWTFile == "" {
+			a.JWTFile = kubernetesJWTFile
+		}
+	default:
+		return fmt.Errorf("Unsupported Vault auth method %s", a.Method)
+	}
+
+	if a.Mount == "" && (a.Method == "approle" || a.Method == "kubernetes") {
+		a.Mount = a.Method
+	}
+	return nil
 }
 
 func (v Vault) HostURL() string {
 	return fmt.Sprintf("%s://%s:%d", v.Proto, v.Host, v.Port)
 }
 
+// enabled reports whether the Vault backend is defined
+func (v Vault) enabled() bool {
+	return v.Host != "" || len(v.Addresses) > 0
+}
+
+// addresses returns the URLs of the Vault servers
+func (v Vault) addresses() []string {
+	if len(v.Addresses) > 0 {
+		return v.Addresses
+	}
+	return []string{v.HostURL()}
+}
+
+type Htpasswd struct {
+	Path string `yaml:"path"`
+	ACL  string `yaml:"acl,omitempty"`
+}
+
+type LDAP struct {
+	URL                string            `yaml:"url"`
+	StartTLS           bool              `yaml:"start_tls,omitempty"`
+	CACert             string            `yaml:"ca_cert,omitempty"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify,omitempty"`
+	UserDN             string            `yaml:"user_dn,omitempty"`
+	BindDN             string            `yaml:"bind_dn,omitempty"`
+	BindPassword       string            `yaml:"bind_password,omitempty"`
+	BaseDN             string            `yaml:"base_dn,omitempty"`
+	UserFilter         string            `yaml:"user_filter,omitempty"`
+	GroupBaseDN        string            `yaml:"group_base_dn,omitempty"`
+	GroupFilter        string            `yaml:"group_filter,omitempty"`
+	GroupAttribute     string            `yaml:"group_attribute,omitempty"`
+	Groups             map[string]string `yaml:"groups,omitempty"`
+	Timeout            time.Duration     `yaml:"timeout,omitempty"`
+}
+
 type Duration time.Duration
 
 func (d *Duration) UnmarshalText(b []byte) error {
@@ -62,6 +260,9 @@ type ServerConf struct {
 	Addr    string        `yaml:"addr"`
 	Timeout time.Duration `yaml:"timeout"`
 	TLS     ServerTLS     `yaml:"tls"`
+	// ExternalURL is the URL the clients reach the service with, used in
+	// the discovery document
+	ExternalURL string `yaml:"external_url,omitempty"`
 
 	publicKey  libtrust.PublicKey
 	privateKey libtrust.PrivateKey
@@ -72,14 +273,137 @@ type ServerTLS struct {
 	Key         string `yaml:"key,omitempty"`
 }
 
+// Anonymous defines the repositories which can be pulled without
+// authentication. The repositories may contain wildcards.
+type Anonymous struct {
+	Repositories []string `yaml:"repositories,omitempty"`
+}
+
+// Group defines the members of a group and the access they share
+type Group struct {
+	Members []string `yaml:"members,omitempty"`
+	Access  string   `yaml:"access"`
+}
+
+// Metrics configures the Prometheus metrics. The issued tokens are counted
+// by service for the listed services only, the service comes from the
+// requests and the others are counted as other.
+type Metrics struct {
+	Services []string `yaml:"services,omitempty"`
+}
+
+// Audit configures the audit log of the token requests, which is written
+// to the sink: file, syslog or webhook
+type Audit struct {
+	Sink string `yaml:"sink,omitempty"`
+	// SampleRate is the fraction of the granted requests recorded, the
+	// denied requests are always recorded
+	SampleRate float64      `yaml:"sample_rate,omitempty"`
+	File       AuditFile    `yaml:"file,omitempty"`
+	Syslog     AuditSyslog  `yaml:"syslog,omitempty"`
+	Webhook    AuditWebhook `yaml:"webhook,omitempty"`
+}
+
+// AuditFile is a file sink rotated once it reaches MaxSize megabytes
+type AuditFile struct {
+	Path       string `yaml:"path"`
+	MaxSize    int    `yaml:"max_size,omitempty"`
+	MaxBackups int    `yaml:"max_backups,omitempty"`
+	MaxAge     int    `yaml:"max_age,omitempty"`
+	Compress   bool   `yaml:"compress,omitempty"`
+}
+
+// AuditSyslog is a syslog sink, the local syslog is used without address
+type AuditSyslog struct {
+	Network string `yaml:"network,omitempty"`
+	Address string `yaml:"address,omitempty"`
+	Tag     string `yaml:"tag,omitempty"`
+}
+
+// AuditWebhook is a sink posting the events to the URL
+type AuditWebhook struct {
+	URL       string        `yaml:"url"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
+	QueueSize int           `yaml:"queue_size,omitempty"`
+}
+
+func (a *Audit) validate() error {
+	switch a.Sink {
+	case "":
+		return nil
+	case "file":
+		if a.File.Path == "" {
+			return fmt.Errorf("Missing path for the audit file")
+		}
+		if a.File.MaxSize <= 0 {
+			a.File.MaxSize = 100
+		}
+	case "syslog":
+		if a.Syslog.Tag == "" {
+			a.Syslog.Tag = "godoauth"
+		}
+	case "webhook":
+		u, err := url.Parse(a.Webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid audit webhook url %s", a.Webhook.URL)
+		}
+		if a.Webhook.Timeout <= 0 {
+			a.Webhook.Timeout = time.Duration(5 * time.Second)
+		}
+		if a.Webhook.QueueSize <= 0 {
+			a.Webhook.QueueSize = 1000
+		}
+	default:
+		return fmt.Errorf("Unsupported audit sink %s, expected file, syslog or webhook", a.Sink)
+	}
+
+	switch {
+	case a.SampleRate == 0:
+		a.SampleRate = 1
+	case a.SampleRate < 0 || a.SampleRate > 1:
+		return fmt.Errorf("Invalid audit sample_rate %v, expected a value between 0 and 1", a.SampleRate)
+	}
+	return nil
+}
+
+func (g Group) hasMember(username string) bool {
+	return containsString(g.Members, username)
+}
+
+// sortedGroupNames returns the group names in a deterministic order
+func sortedGroupNames(groups map[string]Group) []string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
 type Token struct {
 	Issuer      string `yaml:"issuer"`
 	Expiration  int64  `yaml:"expiration"`
 	Certificate string `yaml:"certificate"`
 	Key         string `yaml:"key"`
+	// RefreshExpiration is the lifetime of the OAuth2 refresh tokens in
+	// seconds, a negative value disables them
+	RefreshExpiration int64 `yaml:"refresh_expiration,omitempty"`
+	// PreviousCertificates of rotated keys stay published for verification
+	PreviousCertificates []string `yaml:"previous_certificates,omitempty"`
 
-	publicKey  libtrust.PublicKey
-	privateKey libtrust.PrivateKey
+	publicKey    libtrust.PublicKey
+	privateKey   libtrust.PrivateKey
+	signingAlg   string
+	previousKeys []libtrust.PublicKey
 }
 
 func (c *Config) LoadFromFile(path string) error {
@@ -101,34 +425,148 @@ func (c *Config) Parse(rd io.Reader) error {
 		return err
 	}
 
-	if c.Token.Certificate == "" || c.Token.Key == "" {
-		return fmt.Errorf("Missing Certificate or Key for the Token definition")
+	if c.Token.Key == "" {
+		return fmt.Errorf("Missing Key for the Token definition")
 	}
 
-	_, err = url.Parse(c.Storage.Vault.HostURL())
-	if err != nil {
-		return err
+	// the users of the refresh tokens are looked up in LDAP with bind_dn
+	ldapRefresh := c.Storage.LDAP.URL == "" || c.Storage.LDAP.BindDN != ""
+	if c.Token.RefreshExpiration == 0 {
+		c.Token.RefreshExpiration = 7 * 24 * 3600
+		if !ldapRefresh {
+			c.Token.RefreshExpiration = -1
+		}
+	}
+	if c.Token.RefreshExpiration > 0 && !ldapRefresh {
+		return fmt.Errorf("Refresh tokens require the bind_dn of the LDAP definition")
+	}
+
+	if backends := c.Storage.backends(); len(backends) > 1 {
+		return fmt.Errorf("Only one storage backend can be defined, found: %s", strings.Join(backends, ", "))
+	}
+
+	if c.Storage.Vault.enabled() {
+		for i, address := range c.Storage.Vault.addresses() {
+			u, err := url.Parse(address)
+			if err != nil {
+				return err
+			}
+			if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("Invalid Vault address %s", address)
+			}
+			if len(c.Storage.Vault.Addresses) > 0 {
+				c.Storage.Vault.Addresses[i] = strings.TrimSuffix(address, "/")
+			}
+		}
+
+		switch {
+		case c.Storage.Vault.Retries == 0:
+			c.Storage.Vault.Retries = 2
+		case c.Storage.Vault.Retries < 0:
+			c.Storage.Vault.Retries = 0
+		}
+
+		if c.Storage.Vault.HealthCheckInterval <= 0 {
+			c.Storage.Vault.HealthCheckInterval = time.Duration(10 * time.Second)
+		}
+
+		if c.Storage.Vault.Timeout <= 0 {
+			c.Storage.Vault.Timeout = time.Duration(3 * time.Second)
+		}
+
+		if c.Storage.Vault.Pool <= 0 {
+			c.Storage.Vault.Pool = 2
+		}
+
+		if c.Storage.Vault.IdleTimeout <= 0 {
+			c.Storage.Vault.IdleTimeout = time.Duration(90 * time.Second)
+		}
+
+		if cache := &c.Storage.Vault.Cache; cache.Size > 0 {
+			if cache.TTL <= 0 {
+				cache.TTL = time.Duration(30 * time.Second)
+			}
+			if cache.NegativeTTL == 0 {
+				cache.NegativeTTL = time.Duration(5 * time.Second)
+			}
+			if cache.StaleTTL == 0 {
+				cache.StaleTTL = time.Duration(5 * time.Minute)
+			}
+		}
+
+		switch c.Storage.Vault.KVVersion {
+		case 0:
+			c.Storage.Vault.KVVersion = 1
+		case 1, 2:
+		default:
+			return fmt.Errorf("Unsupported Vault kv_version %d", c.Storage.Vault.KVVersion)
+		}
+
+		if c.Storage.Vault.SecretVersion < 0 || (c.Storage.Vault.SecretVersion > 0 && c.Storage.Vault.KVVersion != 2) {
+			return fmt.Errorf("Vault secret_version requires kv_version 2")
+		}
+
+		if err := c.Storage.Vault.Auth.validate(); err != nil {
+			return err
+		}
 	}
 
-	if c.Storage.Vault.Timeout <= 0 {
-		c.Storage.Vault.Timeout = time.Duration(3 * time.Second)
+	if c.Storage.LDAP.URL != "" {
+		if c.Storage.LDAP.UserDN == "" && c.Storage.LDAP.BaseDN == "" {
+			return fmt.Errorf("Missing user_dn or base_dn for the LDAP definition")
+		}
+
+		if c.Storage.LDAP.UserFilter == "" {
+			c.Storage.LDAP.UserFilter = "(uid=%s)"
+		}
+
+		if c.Storage.LDAP.GroupFilter == "" {
+			c.Storage.LDAP.GroupFilter = "(member=%s)"
+		}
+
+		if c.Storage.LDAP.GroupAttribute == "" {
+			c.Storage.LDAP.GroupAttribute = "cn"
+		}
+
+		if c.Storage.LDAP.Timeout <= 0 {
+			c.Storage.LDAP.Timeout = time.Duration(3 * time.Second)
+		}
 	}
 
-	if c.Storage.Vault.Pool <= 0 {
-		c.Storage.Vault.Pool = 2
+	for name, group := range c.Groups {
+		if _, err := parseAccess(group.Access); err != nil {
+			return fmt.Errorf("Invalid access for group %s", name)
+		}
 	}
 
 	if c.HTTP.Timeout <= 0 {
 		c.HTTP.Timeout = time.Duration(5 * time.Second)
 	}
 
-	if c.Log.File != "" {
-		f, err := os.OpenFile(c.Log.File, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
-		if err != nil {
-			log.Fatalf("error opening file: %v", err)
+	if c.HTTP.ExternalURL != "" {
+		u, err := url.Parse(c.HTTP.ExternalURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid http external_url %s", c.HTTP.ExternalURL)
 		}
-		defer f.Close()
-		log.SetOutput(f)
+		c.HTTP.ExternalURL = strings.TrimSuffix(c.HTTP.ExternalURL, "/")
+	}
+
+	if err := c.Audit.validate(); err != nil {
+		return err
+	}
+
+	if c.Log.Level == "" {
+		c.Log.Level = "info"
+	}
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("Invalid log level %s", c.Log.Level)
+	}
+	switch c.Log.Format {
+	case "":
+		c.Log.Format = "logfmt"
+	case "json", "logfmt":
+	default:
+		return fmt.Errorf("Invalid log format %s, expected json or logfmt", c.Log.Format)
 	}
 
 	return nil
@@ -150,22 +588,56 @@ func (c *Config) LoadCerts() error {
 	if alg := jwt.GetSigningMethod(sigAlg); alg == nil {
 		return fmt.Errorf("signing algorithm not supported: %s", sigAlg)
 	}
+	c.Token.signingAlg = sigAlg
+	// published together with the key in the JWK set
+	c.Token.publicKey.AddExtendedField("use", "sig")
+	c.Token.publicKey.AddExtendedField("alg", sigAlg)
+
+	c.Token.previousKeys = nil
+	for _, certFile := range c.Token.PreviousCertificates {
+		pk, err := loadCertificate(certFile)
+		if err != nil {
+			return fmt.Errorf("failed to load previous certificate %s: %s", certFile, err)
+		}
+		pk.AddExtendedField("use", "sig")
+		c.Token.previousKeys = append(c.Token.previousKeys, pk)
+	}
 	return nil
 }
 
-func (c *Config) loadCerts(certFile, keyFile string) (pk libtrust.PublicKey, prk libtrust.PrivateKey, err error) {
-	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+// loadCertificate returns the public key of a PEM encoded x509 certificate
+func loadCertificate(certFile string) (libtrust.PublicKey, error) {
+	b, err := ioutil.ReadFile(certFile)
 	if err != nil {
-		return
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
 	}
-	x509Cert, err := x509.ParseCertificate(certificate.Certificate[0])
+	x509Cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return fromCryptoPublicKey(x509Cert.PublicKey)
+}
+
+// loadCerts loads the token signing key, the certificate is optional and
+// must match the key if given.
+func (c *Config) loadCerts(certFile, keyFile string) (pk libtrust.PublicKey, prk libtrust.PrivateKey, err error) {
+	prk, err = loadPrivateKey(keyFile)
 	if err != nil {
 		return
 	}
-	pk, err = libtrust.FromCryptoPublicKey(x509Cert.PublicKey)
+	if certFile == "" {
+		return prk.PublicKey(), prk, nil
+	}
+	pk, err = loadCertificate(certFile)
 	if err != nil {
 		return
 	}
-	prk, err = libtrust.FromCryptoPrivateKey(certificate.PrivateKey)
+	if pk.KeyID() != prk.KeyID() {
+		err = fmt.Errorf("certificate %s does not match the key %s", certFile, keyFile)
+	}
 	return
 }
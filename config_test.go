@@ -3,6 +3,7 @@ package godoauth
 import (
 	"bytes"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -10,17 +11,23 @@ import (
 var configStruct = Config{
 	Version: "0.1",
 	Log: Log{
-		Level: "info",
-		File:  "/tmp/godoauth.log",
+		Level:  "info",
+		Format: "logfmt",
+		File:   "/tmp/godoauth.log",
 	},
 	Storage: Storage{
 		Vault: Vault{
-			Host:      "127.0.0.1",
-			Proto:     "http",
-			Port:      8200,
-			AuthToken: "dbXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXX",
-			Timeout:   time.Duration(3 * time.Second),
-			Pool:      2,
+			Host:                "127.0.0.1",
+			Proto:               "http",
+			Port:                8200,
+			AuthToken:           "dbXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXX",
+			Timeout:             time.Duration(3 * time.Second),
+			IdleTimeout:         time.Duration(90 * time.Second),
+			Retries:             2,
+			HealthCheckInterval: time.Duration(10 * time.Second),
+			Pool:                2,
+			KVVersion:           1,
+			Auth:                VaultAuth{Method: "token"},
 		},
 	},
 	HTTP: ServerConf{
@@ -35,6 +42,8 @@ var configStruct = Config{
 		Expiration:  800,
 		Key:         "certs/server.key",
 		Certificate: "certs/server.pem",
+
+		RefreshExpiration: 604800,
 	},
 }
 
@@ -147,7 +156,13 @@ func TestParseMinimalConfig(t *testing.T) {
 		t.Fatalf("unexpected default Vault timeout value %s", config.Storage.Vault.Timeout)
 	}
 	if config.Storage.Vault.Pool != 2 {
-		t.Fatalf("unexpected default Vault pool value %s", config.Storage.Vault.Pool)
+		t.Fatalf("unexpected default Vault pool value %d", config.Storage.Vault.Pool)
+	}
+	if config.Storage.Vault.KVVersion != 1 {
+		t.Fatalf("unexpected default Vault kv_version value %d", config.Storage.Vault.KVVersion)
+	}
+	if config.Storage.Vault.IdleTimeout != time.Duration(90*time.Second) {
+		t.Fatalf("unexpected default Vault idle_timeout value %s", config.Storage.Vault.IdleTimeout)
 	}
 	if config.HTTP.Timeout != time.Duration(5*time.Second) {
 		t.Fatalf("unexpected default HTTP timeout value %s", config.Storage.Vault.Timeout)
@@ -162,3 +177,207 @@ func TestParseBrokenVaultConfig(t *testing.T) {
 		t.Fatal("Expected error while parsing config ")
 	}
 }
+
+// TestParseVaultKVVersion validates the KV secrets engine settings
+func TestParseVaultKVVersion(t *testing.T) {
+	tests := []struct {
+		settings string
+		ok       bool
+	}{
+		{"    kv_version: 2\n", true},
+		{"    kv_version: 2\n    secret_version: 3\n", true},
+		{"    kv_version: 3\n", false},
+		{"    secret_version: 3\n", false},
+		{"    kv_version: 2\n    secret_version: -1\n", false},
+	}
+	for _, tt := range tests {
+		var config Config
+		yaml := strings.Replace(MinConfigYamlV0_1, "    proto: http\n", "    proto: http\n"+tt.settings, 1)
+		err := config.Parse(bytes.NewReader([]byte(yaml)))
+		if (err == nil) != tt.ok {
+			t.Errorf("Parse() with %q returned %v", tt.settings, err)
+		}
+	}
+}
+
+func TestParseVaultAddresses(t *testing.T) {
+	yaml := strings.Replace(MinConfigYamlV0_1, "    host: 127.0.0.1\n", "    addresses:\n      - https://vault-1:8200/\n      - https://vault-2:8200\n", 1)
+	yaml = strings.Replace(yaml, "    port: 8200\n", "", 1)
+	var config Config
+	if err := config.Parse(bytes.NewReader([]byte(yaml))); err != nil {
+		t.Fatalf("unexpected error while parsing config file: %s", err)
+	}
+	if !reflect.DeepEqual(config.Storage.Vault.addresses(), []string{"https://vault-1:8200", "https://vault-2:8200"}) {
+		t.Errorf("unexpected Vault addresses %v", config.Storage.Vault.addresses())
+	}
+	if config.Storage.Vault.Retries != 2 || config.Storage.Vault.HealthCheckInterval != 10*time.Second {
+		t.Errorf("unexpected Vault retry defaults %d, %s", config.Storage.Vault.Retries, config.Storage.Vault.HealthCheckInterval)
+	}
+
+	yaml = strings.Replace(yaml, "https://vault-2:8200", "vault-2:8200", 1)
+	config = Config{}
+	if err := config.Parse(bytes.NewReader([]byte(yaml))); err == nil {
+		t.Errorf("expected error for Vault address without scheme")
+	}
+}
+
+// HtpasswdYamlV0_1 is a Version 0.1 yaml document using the htpasswd backend
+var HtpasswdYamlV0_1 = `
+---
+version: 0.1
+storage:
+  htpasswd:
+    path: /etc/docker/godoauth/htpasswd
+    acl: /etc/docker/godoauth/acl
+http:
+  addr: :5002
+token:
+   issuer: Token
+   expiration: 800
+   certificate: certs/server.pem
+   key: certs/server.key
+`
+
+// TestParseHtpasswdConfig validates the htpasswd backend settings
+func TestParseHtpasswdConfig(t *testing.T) {
+	var config Config
+	err := config.Parse(bytes.NewReader([]byte(HtpasswdYamlV0_1)))
+	if err != nil {
+		t.Fatalf("unexpected error while parsing config file: %s", err)
+	}
+	expected := Htpasswd{
+		Path: "/etc/docker/godoauth/htpasswd",
+		ACL:  "/etc/docker/godoauth/acl",
+	}
+	if config.Storage.Htpasswd != expected {
+		t.Fatalf("unexpected htpasswd config %v", config.Storage.Htpasswd)
+	}
+	if !reflect.DeepEqual(config.Storage.Vault, Vault{}) {
+		t.Fatalf("unexpected vault config %v", config.Storage.Vault)
+	}
+}
+
+// TestParseMultipleBackends validates only one storage backend is accepted
+func TestParseMultipleBackends(t *testing.T) {
+	var config Config
+	yaml := strings.Replace(configYamlV0_1, "storage:\n", "storage:\n  htpasswd:\n    path: /etc/docker/godoauth/htpasswd\n", 1)
+	err := config.Parse(bytes.NewReader([]byte(yaml)))
+	if err == nil {
+		t.Fatal("Expected error while parsing config with multiple backends")
+	}
+}
+
+// TestParseGroups validates the groups defined in the config file
+func TestParseGroups(t *testing.T) {
+	var config Config
+	yaml := configYamlV0_1 + `
+groups:
+  admins:
+    members:
+      - foo
+      - bar
+    access: repository:*:*
+`
+	err := config.Parse(bytes.NewReader([]byte(yaml)))
+	if err != nil {
+		t.Fatalf("unexpected error while parsing config file: %s", err)
+	}
+	expected := map[string]Group{
+		"admins": {Members: []string{"foo", "bar"}, Access: "repository:*:*"},
+	}
+	if !reflect.DeepEqual(config.Groups, expected) {
+		t.Fatalf("unexpected groups %v", config.Groups)
+	}
+
+	config = Config{}
+	err = config.Parse(bytes.NewReader([]byte(yaml + "  broken:\n    access: foo/bar:*\n")))
+	if err == nil {
+		t.Fatal("Expected error while parsing config with invalid group access")
+	}
+}
+
+// TestParseAudit validates the audit sink settings
+func TestParseAudit(t *testing.T) {
+	tests := []struct {
+		settings string
+		ok       bool
+	}{
+		{"  sink: file\n  file:\n    path: /var/log/godoauth/audit.log\n", true},
+		{"  sink: file\n", false},
+		{"  sink: syslog\n", true},
+		{"  sink: webhook\n  webhook:\n    url: https://audit.example.com/events\n", true},
+		{"  sink: webhook\n  webhook:\n    url: audit.example.com\n", false},
+		{"  sink: kafka\n", false},
+		{"  sink: syslog\n  sample_rate: 0.5\n", true},
+		{"  sink: syslog\n  sample_rate: 2\n", false},
+	}
+	for _, tt := range tests {
+		var config Config
+		err := config.Parse(bytes.NewReader([]byte(MinConfigYamlV0_1 + "audit:\n" + tt.settings)))
+		if (err == nil) != tt.ok {
+			t.Errorf("Parse() with %q returned %v", tt.settings, err)
+		}
+	}
+
+	var config Config
+	yaml := MinConfigYamlV0_1 + "audit:\n  sink: webhook\n  webhook:\n    url: https://audit.example.com/events\n"
+	if err := config.Parse(bytes.NewReader([]byte(yaml))); err != nil {
+		t.Fatalf("unexpected error while parsing config file: %s", err)
+	}
+	expected := Audit{
+		Sink:       "webhook",
+		SampleRate: 1,
+		Webhook:    AuditWebhook{URL: "https://audit.example.com/events", Timeout: 5 * time.Second, QueueSize: 1000},
+	}
+	if config.Audit != expected {
+		t.Errorf("unexpected audit config %+v", config.Audit)
+	}
+}
+
+// TestParseLDAPRefresh validates refresh tokens are only enabled with the
+// bind_dn used to look up the LDAP users
+func TestParseLDAPRefresh(t *testing.T) {
+	ldapYaml := strings.Replace(HtpasswdYamlV0_1, "  htpasswd:\n    path: /etc/docker/godoauth/htpasswd\n    acl: /etc/docker/godoauth/acl\n",
+		"  ldap:\n    url: ldap://ldap.example.org\n    user_dn: uid=%s,ou=people,dc=example,dc=org\n", 1)
+
+	var config Config
+	if err := config.Parse(bytes.NewReader([]byte(ldapYaml))); err != nil {
+		t.Fatalf("unexpected error while parsing config file: %s", err)
+	}
+	if config.Token.RefreshExpiration >= 0 {
+		t.Errorf("refresh tokens enabled without bind_dn")
+	}
+
+	config = Config{}
+	yaml := strings.Replace(ldapYaml, "   key: certs/server.key\n", "   key: certs/server.key\n   refresh_expiration: 3600\n", 1)
+	if err := config.Parse(bytes.NewReader([]byte(yaml))); err == nil {
+		t.Errorf("expected error for refresh_expiration without bind_dn")
+	}
+
+	config = Config{}
+	yaml = strings.Replace(ldapYaml, "    url: ldap://ldap.example.org\n", "    url: ldap://ldap.example.org\n    bind_dn: cn=admin,dc=example,dc=org\n", 1)
+	if err := config.Parse(bytes.NewReader([]byte(yaml))); err != nil {
+		t.Fatalf("unexpected error while parsing config file: %s", err)
+	}
+	if config.Token.RefreshExpiration != 7*24*3600 {
+		t.Errorf("unexpected refresh_expiration %d with bind_dn", config.Token.RefreshExpiration)
+	}
+}
+
+// TestParseExternalURL validates the external_url of the http section
+func TestParseExternalURL(t *testing.T) {
+	var config Config
+	yaml := strings.Replace(MinConfigYamlV0_1, "http:\n", "http:\n  external_url: https://auth.example.com/\n", 1)
+	if err := config.Parse(bytes.NewReader([]byte(yaml))); err != nil {
+		t.Fatalf("unexpected error while parsing config file: %s", err)
+	}
+	if config.HTTP.ExternalURL != "https://auth.example.com" {
+		t.Errorf("unexpected external_url %q", config.HTTP.ExternalURL)
+	}
+
+	config = Config{}
+	yaml = strings.Replace(MinConfigYamlV0_1, "http:\n", "http:\n  external_url: auth.example.com\n", 1)
+	if err := config.Parse(bytes.NewReader([]byte(yaml))); err == nil {
+		t.Errorf("expected error for external_url without scheme")
+	}
+}
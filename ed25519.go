@@ -0,0 +1,223 @@
+package godoauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/docker/libtrust"
+)
+
+// libtrust only knows RSA and EC keys, the Ed25519 keys implement its
+// interfaces so they can be used everywhere the other keys are.
+
+// algEdDSA is the JWS algorithm of the Ed25519 signatures (RFC 8037)
+const algEdDSA = "EdDSA"
+
+type ed25519PublicKey struct {
+	key      ed25519.PublicKey
+	extended map[string]interface{}
+}
+
+type ed25519PrivateKey struct {
+	*ed25519PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+func newEd25519PrivateKey(key ed25519.PrivateKey) *ed25519PrivateKey {
+	return &ed25519PrivateKey{
+		ed25519PublicKey: newEd25519PublicKey(key.Public().(ed25519.PublicKey)),
+		privateKey:       key,
+	}
+}
+
+func newEd25519PublicKey(key ed25519.PublicKey) *ed25519PublicKey {
+	return &ed25519PublicKey{
+		key:      key,
+		extended: make(map[string]interface{}),
+	}
+}
+
+func (k *ed25519PublicKey) KeyType() string {
+	return "OKP"
+}
+
+// KeyID returns the libtrust fingerprint of the key
+func (k *ed25519PublicKey) KeyID() string {
+	der, err := x509.MarshalPKIXPublicKey(k.key)
+	if err != nil {
+		return ""
+	}
+	hasher := crypto.SHA256.New()
+	hasher.Write(der)
+	return keyIDEncode(hasher.Sum(nil)[:30])
+}
+
+// keyIDEncode formats the key ID in the 12 base32 groups used by libtrust
+func keyIDEncode(b []byte) string {
+	s := strings.TrimRight(base32.StdEncoding.EncodeToString(b), "=")
+	var buf bytes.Buffer
+	var i int
+	for i = 0; i < len(s)/4-1; i++ {
+		buf.WriteString(s[i*4:i*4+4] + ":")
+	}
+	buf.WriteString(s[i*4:])
+	return buf.String()
+}
+
+func (k *ed25519PublicKey) Verify(data io.Reader, alg string, signature []byte) error {
+	if alg != algEdDSA {
+		return fmt.Errorf("unable to verify signature: Ed25519 key does not support %s", alg)
+	}
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(k.key, b, signature) {
+		return errors.New("invalid Ed25519 signature")
+	}
+	return nil
+}
+
+func (k *ed25519PublicKey) CryptoPublicKey() crypto.PublicKey {
+	return k.key
+}
+
+func (k *ed25519PublicKey) toMap() map[string]interface{} {
+	jwk := make(map[string]interface{})
+	for field, v := range k.extended {
+		jwk[field] = v
+	}
+	jwk["kty"] = k.KeyType()
+	jwk["kid"] = k.KeyID()
+	jwk["crv"] = "Ed25519"
+	jwk["x"] = base64.RawURLEncoding.EncodeToString(k.key)
+	return jwk
+}
+
+// MarshalJSON serializes the key as an OKP JSON Web Key (RFC 8037)
+func (k *ed25519PublicKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.toMap())
+}
+
+func (k *ed25519PublicKey) PEMBlock() (*pem.Block, error) {
+	der, err := x509.MarshalPKIXPublicKey(k.key)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PUBLIC KEY", Headers: map[string]string{"kid": k.KeyID()}, Bytes: der}, nil
+}
+
+func (k *ed25519PublicKey) String() string {
+	return fmt.Sprintf("Ed25519 Public Key <%s>", k.KeyID())
+}
+
+func (k *ed25519PublicKey) AddExtendedField(field string, value interface{}) {
+	k.extended[field] = value
+}
+
+func (k *ed25519PublicKey) GetExtendedField(field string) interface{} {
+	return k.extended[field]
+}
+
+func (k *ed25519PrivateKey) PublicKey() libtrust.PublicKey {
+	return k.ed25519PublicKey
+}
+
+// Sign signs the data with Ed25519, which doesn't use a separate hash
+// function so hashID is ignored.
+func (k *ed25519PrivateKey) Sign(data io.Reader, hashID crypto.Hash) ([]byte, string, error) {
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return ed25519.Sign(k.privateKey, b), algEdDSA, nil
+}
+
+func (k *ed25519PrivateKey) CryptoPrivateKey() crypto.PrivateKey {
+	return k.privateKey
+}
+
+func (k *ed25519PrivateKey) MarshalJSON() ([]byte, error) {
+	jwk := k.toMap()
+	jwk["d"] = base64.RawURLEncoding.EncodeToString(k.privateKey.Seed())
+	return json.Marshal(jwk)
+}
+
+func (k *ed25519PrivateKey) PEMBlock() (*pem.Block, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Headers: map[string]string{"kid": k.KeyID()}, Bytes: der}, nil
+}
+
+func (k *ed25519PrivateKey) String() string {
+	return fmt.Sprintf("Ed25519 Private Key <%s>", k.KeyID())
+}
+
+// ed25519PrivateKeyFromJWK returns the private key of an OKP JSON Web Key
+func ed25519PrivateKeyFromJWK(jwk map[string]interface{}) (*ed25519PrivateKey, error) {
+	if crv, _ := jwk["crv"].(string); crv != "Ed25519" {
+		return nil, fmt.Errorf("JWK OKP curve not supported: %q", jwk["crv"])
+	}
+	d, _ := jwk["d"].(string)
+	seed, err := base64.RawURLEncoding.DecodeString(d)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("JWK Ed25519 private key: invalid \"d\" value")
+	}
+	key := newEd25519PrivateKey(ed25519.NewKeyFromSeed(seed))
+
+	if x, ok := jwk["x"].(string); ok && x != base64.RawURLEncoding.EncodeToString(key.key) {
+		return nil, fmt.Errorf("JWK Ed25519 public key does not match the private key")
+	}
+	return key, nil
+}
+
+// signingMethodEdDSA registers the EdDSA algorithm with jwt-go, the keys are
+// ed25519.PrivateKey and ed25519.PublicKey.
+type signingMethodEdDSA struct{}
+
+func init() {
+	jwt.RegisterSigningMethod(algEdDSA, func() jwt.SigningMethod {
+		return signingMethodEdDSA{}
+	})
+}
+
+func (signingMethodEdDSA) Alg() string {
+	return algEdDSA
+}
+
+func (signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKey
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func (signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKey
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
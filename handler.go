@@ -1,6 +1,10 @@
 package godoauth
 
-import "net/http"
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
 
 type Handler struct {
 	*http.ServeMux
@@ -13,7 +17,12 @@ func NewHandler(authHandler *TokenAuthHandler) *Handler {
 	}
 
 	s.Handle("/auth", authHandler)
+	s.Handle("/token", authHandler)
+	s.HandleFunc("/token/revoke", authHandler.ServeRevoke)
+	s.HandleFunc(jwksPath, authHandler.ServeJWKS)
+	s.HandleFunc("/.well-known/openid-configuration", authHandler.ServeOpenIDConfiguration)
 	s.HandleFunc("/server-ping", s.ping)
+	s.Handle("/metrics", promhttp.Handler())
 	return s
 }
 
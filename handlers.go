@@ -3,55 +3,95 @@ package godoauth
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"math/rand"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 )
 
+// Priv is the bitmask of the actions granted on a resource
 type Priv uint
 
 const (
-	PrivPush    Priv = 1
-	PrivPull         = 2
-	PrivAll          = 3 // NB: equivlant to (PrivPush | PrivPull)
-	PrivIllegal      = 4
+	PrivPush Priv = 1 << iota
+	PrivPull
+	PrivDelete
+	PrivIllegal
+
+	PrivAll = PrivPush | PrivPull | PrivDelete
 )
 
+// privActions maps the action names to their privilege, in the order
+// Actions emits them
+var privActions = []struct {
+	name string
+	priv Priv
+}{
+	{"push", PrivPush},
+	{"pull", PrivPull},
+	{"delete", PrivDelete},
+}
+
 func (p Priv) Has(q Priv) bool {
 	return (p&q == q)
 }
 
 func (p Priv) Valid() bool {
-	return (PrivPush <= p && p < PrivIllegal)
+	return p != 0 && p&^PrivAll == 0
 }
 
+// NewPriv parses a comma separated list of actions in any order, "*" grants
+// all of them. Unknown actions make the whole list PrivIllegal.
 func NewPriv(privilege string) Priv {
-	switch privilege {
-	case "push":
-		return PrivPush
-	case "pull":
-		return PrivPull
-	case "push,pull", "pull,push", "*":
-		return PrivPush | PrivPull
-	default:
-		return PrivIllegal
+	return parsePriv(privilege, PrivAll)
+}
+
+// accessPriv parses the actions of an access entry. On repositories "*" only
+// grants push and pull as before the delete action existed, delete has to be
+// listed explicitly.
+func accessPriv(typ, privilege string) Priv {
+	if typ == "registry" {
+		return parsePriv(privilege, PrivAll)
 	}
+	return parsePriv(privilege, PrivPush|PrivPull)
 }
 
-func (p Priv) Actions() []string {
-	var result []string
-	if p.Has(PrivPush) {
-		result = append(result, "push")
+// parsePriv parses the list of actions, "*" grants the wildcard privileges
+func parsePriv(privilege string, wildcard Priv) Priv {
+	var p Priv
+	for _, action := range strings.Split(privilege, ",") {
+		if action == "*" {
+			p |= wildcard
+			continue
+		}
+		q := privFromAction(action)
+		if q == 0 {
+			return PrivIllegal
+		}
+		p |= q
 	}
+	return p
+}
 
-	if p.Has(PrivPull) {
-		result = append(result, "pull")
+func privFromAction(action string) Priv {
+	for _, a := range privActions {
+		if a.name == action {
+			return a.priv
+		}
+	}
+	return 0
+}
+
+func (p Priv) Actions() []string {
+	var result []string
+	for _, a := range privActions {
+		if p.Has(a.priv) {
+			result = append(result, a.name)
+		}
 	}
 	return result
 }
@@ -65,48 +105,112 @@ func (p Priv) Actions() []string {
 type TokenAuthHandler struct {
 	// Main config file ... similar as in the server handler
 	Config *Config
+	// Backend used to authenticate the users and retrieve their access
+	Backend UserBackend
 	// Account name of the user
 	Account string
 	// Service identifier ... One Auth server may be source of true for different services
 	Service string
+	// RefreshTokens keeps the refresh tokens of the OAuth2 flow, nil disables them
+	RefreshTokens *RefreshTokenStore
+	// Keys signing the tokens, the key of Config.Token is used if nil
+	Keys *Keyring
+	// Logger of the requests, the standard logger of logrus if nil
+	Logger *logrus.Logger
+	// Audit records the token requests, no audit log is written if nil
+	Audit AuditSink
+}
+
+// keyring returns the keys signing and verifying the tokens
+func (h *TokenAuthHandler) keyring() *Keyring {
+	if h.Keys != nil {
+		return h.Keys
+	}
+	return NewKeyring(&h.Config.Token)
+}
+
+// logger returns the logger of the requests
+func (h *TokenAuthHandler) logger() *logrus.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return logrus.StandardLogger()
 }
 
 // Scope definition
 type Scope struct {
-	Type    string // repository
+	Type    string // repository or registry
+	Class   string // plugin, only for the repository(plugin) form
 	Name    string // foo/bar
 	Actions Priv   // Priv who would guess that ?
 }
 
 // UnmarshalText decodes the Scope data from the standard text-form:
-// <type>:<name>:<actions>
+// <type>[(<class>)]:<name>:<actions>
+//
+// The name may contain a registry hostname with a port, so the type ends
+// at the first colon and the actions start after the last one.
 func (s *Scope) UnmarshalText(b []byte) error {
-	split := strings.Split(string(b), ":")
-	if len(split) != 3 {
+	text := string(b)
+	first, last := strings.Index(text, ":"), strings.LastIndex(text, ":")
+	if first < 0 || first == last || first+1 == last {
 		return fmt.Errorf("malformed scope")
 	}
 
-	if split[0] != "repository" {
-		return fmt.Errorf("malformed scope: 'repository' not specified")
+	typ, class := text[:first], ""
+	if i := strings.Index(typ, "("); i > 0 && strings.HasSuffix(typ, ")") {
+		typ, class = typ[:i], typ[i+1:len(typ)-1]
+		if class == "" {
+			return fmt.Errorf("malformed scope: empty resource class")
+		}
+	}
+
+	switch typ {
+	case "repository":
+	case "registry":
+		if class != "" {
+			return fmt.Errorf("malformed scope: registry has no resource class")
+		}
+	default:
+		return fmt.Errorf("malformed scope: unsupported resource type %q", typ)
 	}
 
-	p := NewPriv(split[2])
+	p := NewPriv(text[last+1:])
 	if !p.Valid() {
 		return fmt.Errorf("malformed scope: invalid privilege")
 	}
 
-	s.Type = split[0]
-	s.Name = split[1]
+	s.Type = typ
+	s.Class = class
+	s.Name = text[first+1 : last]
 	s.Actions = p
 	return nil
 }
 
+// actions returns the action names of the scope as expected in the access
+// claim, registry scopes like the catalog only know the "*" action
+func (s *Scope) actions() []string {
+	if s.Type == "registry" && s.Actions.Has(PrivAll) {
+		return []string{"*"}
+	}
+	return s.Actions.Actions()
+}
+
+// String returns the scope in the text-form decoded by UnmarshalText
+func (s *Scope) String() string {
+	typ := s.Type
+	if s.Class != "" {
+		typ += "(" + s.Class + ")"
+	}
+	return typ + ":" + s.Name + ":" + strings.Join(s.actions(), ",")
+}
+
 // AuthRequest holds the parsed client request
 type AuthRequest struct {
 	Service  string
 	Account  string
 	Password string
-	Scope    *Scope
+	Scopes   []*Scope
 }
 
 func actionAllowed(reqscopes *Scope, vuser *UserInfo) *Scope {
@@ -114,14 +218,15 @@ func actionAllowed(reqscopes *Scope, vuser *UserInfo) *Scope {
 		return &Scope{}
 	}
 
-	allowedPrivs := vuser.Access[reqscopes.Name]
+	allowedPrivs := vuser.Priv(resourceKey(reqscopes.Type, reqscopes.Name))
 
 	if allowedPrivs.Has(reqscopes.Actions) {
 		return reqscopes
 	}
 	if (allowedPrivs & reqscopes.Actions) > 0 {
 		return &Scope{
-			Type:    "repository",
+			Type:    reqscopes.Type,
+			Class:   reqscopes.Class,
 			Name:    reqscopes.Name,
 			Actions: allowedPrivs & reqscopes.Actions,
 		}
@@ -129,43 +234,97 @@ func actionAllowed(reqscopes *Scope, vuser *UserInfo) *Scope {
 	return &Scope{}
 }
 
-type idKeyType int
-
-var idKey = idKeyType(0)
+// anonymousUser returns the user used for the anonymous requests, it has
+// pull access to the repositories matching the public patterns
+func (h *TokenAuthHandler) anonymousUser() *UserInfo {
+	access := make(map[string]Priv)
+	for _, pattern := range h.Config.Anonymous.Repositories {
+		access[pattern] = PrivPull
+	}
+	return &UserInfo{Access: access}
+}
 
-func logWithID(ctx context.Context, pattern string, vars ...interface{}) {
-	id := ctx.Value(idKey)
-	vars = append([]interface{}{id}, vars...)
-	log.Printf("%d "+pattern, vars...)
+// grantScopes returns the requested scopes reduced to the actions allowed for
+// the user or by the anonymous access, scopes without any action are dropped
+func (h *TokenAuthHandler) grantScopes(scopes []*Scope, user *UserInfo) []*Scope {
+	anonymous := h.anonymousUser()
+
+	var granted []*Scope
+	for _, reqscope := range scopes {
+		allowed := actionAllowed(reqscope, user)
+		if public := actionAllowed(reqscope, anonymous); public.Type != "" {
+			allowed = &Scope{
+				Type:    reqscope.Type,
+				Class:   reqscope.Class,
+				Name:    reqscope.Name,
+				Actions: allowed.Actions | public.Actions,
+			}
+		}
+		if allowed.Type != "" {
+			granted = append(granted, allowed)
+		}
+	}
+	return granted
 }
 
 func (h *TokenAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	ctx = context.WithValue(ctx, idKey, rand.Int31())
+	ctx := withRequestLog(context.Background(), h.logger(), logrus.Fields{
+		"request_id": fmt.Sprintf("%08x", rand.Uint32()),
+		"client_ip":  clientIP(r),
+	})
+	ctx = withAuditEvent(ctx, &AuditEvent{Time: time.Now().UTC(), RemoteAddr: r.RemoteAddr})
 	ctx, cancel := context.WithTimeout(ctx, h.Config.HTTP.Timeout)
 	defer cancel()
 
-	logWithID(ctx, "GET %v", r.RequestURI)
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+	defer func() {
+		observeRequest(rec, start)
+		ctxLogger(ctx).WithFields(logrus.Fields{
+			"status":     rec.code,
+			"outcome":    rec.outcome(),
+			"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+		}).Info("request completed")
+		h.audit(ctx, rec)
+	}()
+	w = rec
+
+	ctxLogger(ctx).Debugf("%s %v", r.Method, r.RequestURI)
+
+	// newer docker clients use the OAuth2 form of the token request
+	if r.Method == "POST" {
+		h.serveOAuth(ctx, w, r)
+		return
+	}
 
 	authRequest, err := parseRequest(r)
 	if err != nil {
-		logWithID(ctx, err.Error())
+		ctxLogger(ctx).Info(err.Error())
 		http.Error(w, err.Error(), err.(*HTTPAuthError).Code)
 		return
 	}
+	addLogFields(ctx, logrus.Fields{
+		"service": authRequest.Service,
+		"account": authRequest.Account,
+		"scope":   scopeList(authRequest.Scopes),
+	})
+	audit := auditEvent(ctx)
+	audit.Service = authRequest.Service
+	audit.Account = authRequest.Account
+	audit.Requested = scopeStrings(authRequest.Scopes)
 
 	// you need at least one of the parameter to be non empty
 	// if only account true you authenticate only
 	// if only scope true you ask for anonymous priv
-	if authRequest.Account == "" && authRequest.Scope == nil {
+	if authRequest.Account == "" && len(authRequest.Scopes) == 0 {
 		err := HTTPBadRequest("malformed scope")
 		http.Error(w, err.Error(), err.Code)
 		return
 	}
 
-	// BUG(dejan) we do not support anonymous images yet
-	if authRequest.Account == "" {
-		http.Error(w, "Public repos not supported yet", ErrUnauthorized.Code)
+	// anonymous requests are only allowed to pull public repositories
+	if authRequest.Account == "" && len(h.Config.Anonymous.Repositories) == 0 {
+		http.Error(w, "Public repos not supported", ErrUnauthorized.Code)
 		return
 	}
 
@@ -176,34 +335,62 @@ func (h *TokenAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userdata, err := h.authAccount(ctx, authRequest)
-	if err != nil {
-		logWithID(ctx, "Auth failed %s", err)
-		http.Error(w, err.Error(), err.(*HTTPAuthError).Code)
-		return
-	}
-	if userdata == nil {
-		http.Error(w, "User has no access", http.StatusForbidden)
-		return
+	userdata := h.anonymousUser()
+	if authRequest.Account != "" {
+		userdata, err = h.authAccount(ctx, authRequest)
+		if err != nil {
+			ctxLogger(ctx).Infof("Auth failed %s", err)
+			http.Error(w, err.Error(), err.(*HTTPAuthError).Code)
+			return
+		}
+		if userdata == nil {
+			http.Error(w, "User has no access", http.StatusForbidden)
+			return
+		}
 	}
 
-	grantedActions := actionAllowed(authRequest.Scope, userdata)
+	grantedActions := h.grantScopes(authRequest.Scopes, userdata)
+	notePartialGrant(w, authRequest.Scopes, grantedActions)
+	addLogFields(ctx, logrus.Fields{"granted": scopeList(grantedActions)})
+	audit.Granted = scopeStrings(grantedActions)
 
-	stringToken, err := h.CreateToken(grantedActions, authRequest.Service, authRequest.Account)
+	token, err := h.CreateToken(grantedActions, authRequest.Service, authRequest.Account)
 	if err != nil {
-		logWithID(ctx, "token error %s", err)
+		ctxLogger(ctx).Errorf("token error %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	audit.JTI = token.ID
+
+	tokenOutput := newTokenResponse(token)
+	// older clients only know the token field
+	tokenOutput.Token = token.Token
+	writeTokenResponse(ctx, w, tokenOutput)
+}
+
+// tokenResponse is the response body of the token requests as described by
+// the Docker Token Specification
+type tokenResponse struct {
+	Token        string `json:"token,omitempty"`
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	IssuedAt     string `json:"issued_at"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
 
-	tokenOutput := struct {
-		Token string `json:"token"`
-	}{
-		Token: stringToken,
+// newTokenResponse returns the response body for the signed token
+func newTokenResponse(token *SignedToken) *tokenResponse {
+	return &tokenResponse{
+		AccessToken: token.Token,
+		ExpiresIn:   token.ExpiresIn(),
+		IssuedAt:    token.IssuedAt.UTC().Format(time.RFC3339),
 	}
+}
+
+func writeTokenResponse(ctx context.Context, w http.ResponseWriter, tokenOutput *tokenResponse) {
 	tokenBytes, err := json.Marshal(tokenOutput)
 	if err != nil {
-		logWithID(ctx, "error marshalling token output: %v", err)
+		ctxLogger(ctx).Errorf("error marshalling token output: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -212,64 +399,146 @@ func (h *TokenAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	_, err = w.Write(tokenBytes)
 	if err != nil {
-		logWithID(ctx, "error writing result to client: %v", err)
+		ctxLogger(ctx).Warnf("error writing result to client: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
 	}
-	logWithID(ctx, "Auth granted")
 }
 
 func (h *TokenAuthHandler) authAccount(ctx context.Context, authRequest *AuthRequest) (*UserInfo, error) {
-	vaultClient := VaultClient{Config: &h.Config.Storage.Vault}
-	vuser, err := vaultClient.RetrieveUser(ctx, authRequest.Service, authRequest.Account)
+	user, err := h.Backend.RetrieveUser(ctx, authRequest.Service, authRequest.Account)
 	if err != nil {
 		return nil, err
 	}
 
-	if vuser.Password == authRequest.Password {
-		return vuser, nil
+	ok, err := h.Backend.Authenticate(ctx, user, authRequest.Password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
 	}
-	return nil, nil
+
+	if err := h.userAccess(ctx, authRequest.Service, user); err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
-func (h *TokenAuthHandler) CreateToken(scopes *Scope, service, account string) (string, error) {
-	// Sign something dummy to find out which algorithm is used.
-	_, sigAlg, err := h.Config.Token.privateKey.Sign(strings.NewReader("whoami"), 0)
+// userAccess retrieves the access of the user and of its groups
+func (h *TokenAuthHandler) userAccess(ctx context.Context, service string, user *UserInfo) error {
+	var err error
+	user.Access, err = h.Backend.Access(ctx, user)
 	if err != nil {
-		return "", fmt.Errorf("failed to sign: %s", err)
+		return err
 	}
+	return h.resolveGroups(ctx, service, user)
+}
 
-	token := jwt.New(jwt.GetSigningMethod(sigAlg))
-	token.Header["kid"] = h.Config.Token.publicKey.KeyID()
+// resolveGroups adds the groups from the config file the user is member of
+// and retrieves the access of all the user groups. Groups defined in the
+// config file take precedence over the ones stored in the backend.
+func (h *TokenAuthHandler) resolveGroups(ctx context.Context, service string, user *UserInfo) error {
+	for _, name := range sortedGroupNames(h.Config.Groups) {
+		if h.Config.Groups[name].hasMember(user.Username) && !containsString(user.Groups, name) {
+			user.Groups = append(user.Groups, name)
+		}
+	}
+
+	groupBackend, _ := h.Backend.(GroupBackend)
+	user.GroupAccess = make(map[string]map[string]Priv)
+	for _, name := range user.Groups {
+		if group, ok := h.Config.Groups[name]; ok {
+			access, err := parseAccess(group.Access)
+			if err != nil {
+				return err
+			}
+			user.GroupAccess[name] = access
+			continue
+		}
+
+		if groupBackend == nil {
+			continue
+		}
+		access, err := groupBackend.RetrieveGroup(ctx, service, name)
+		if err != nil {
+			return err
+		}
+		user.GroupAccess[name] = access
+	}
+	return nil
+}
+
+// accessEntry is a single element of the access claim of the JWT token
+type accessEntry struct {
+	Type    string   `json:"type"`
+	Class   string   `json:"class,omitempty"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// SignedToken is a signed JWT token together with the claims the clients
+// need to know when to request a new one
+type SignedToken struct {
+	Token     string
+	ID        string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// ExpiresIn returns the lifetime of the token in seconds
+func (t *SignedToken) ExpiresIn() int64 {
+	return t.ExpiresAt.Unix() - t.IssuedAt.Unix()
+}
+
+// CreateToken creates a signed JWT token for the account with one
+// access claim entry for each of the granted scopes.
+func (h *TokenAuthHandler) CreateToken(scopes []*Scope, service, account string) (*SignedToken, error) {
+	key := h.keyring().signingKey()
+	if key.privateKey == nil {
+		return nil, fmt.Errorf("token signing key not loaded")
+	}
+
+	token := jwt.New(jwt.GetSigningMethod(key.alg))
+	token.Header["kid"] = key.publicKey.KeyID()
 
 	token.Claims["iss"] = h.Config.Token.Issuer
 	token.Claims["sub"] = account
 	token.Claims["aud"] = service
 
-	now := time.Now().Unix()
-	token.Claims["exp"] = now + h.Config.Token.Expiration
-	token.Claims["nbf"] = now - 1
-	token.Claims["iat"] = now
-	token.Claims["jti"] = fmt.Sprintf("%d", rand.Int63())
-
-	if scopes.Type != "" {
-		token.Claims["access"] = []struct {
-			Type, Name string
-			Actions    []string
-		}{
-			{
-				scopes.Type,
-				scopes.Name,
-				scopes.Actions.Actions(),
-			},
+	// the claims have a precision of one second
+	issuedAt := time.Unix(time.Now().Unix(), 0)
+	expiresAt := issuedAt.Add(time.Duration(h.Config.Token.Expiration) * time.Second)
+	id := fmt.Sprintf("%d", rand.Int63())
+
+	token.Claims["exp"] = expiresAt.Unix()
+	token.Claims["nbf"] = issuedAt.Unix() - 1
+	token.Claims["iat"] = issuedAt.Unix()
+	token.Claims["jti"] = id
+
+	if len(scopes) > 0 {
+		access := make([]accessEntry, 0, len(scopes))
+		for _, scope := range scopes {
+			access = append(access, accessEntry{
+				Type:    scope.Type,
+				Class:   scope.Class,
+				Name:    scope.Name,
+				Actions: scope.actions(),
+			})
 		}
+		token.Claims["access"] = access
 	}
 
-	f, err := ioutil.ReadFile(h.Config.Token.Key)
+	signed, err := key.sign(token)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return token.SignedString(f)
+	tokensIssued.WithLabelValues(h.Config.Metrics.serviceLabel(service)).Inc()
+	return &SignedToken{
+		Token:     signed,
+		ID:        id,
+		IssuedAt:  issuedAt,
+		ExpiresAt: expiresAt,
+	}, nil
 }
 
 func getService(req *http.Request) (string, error) {
@@ -280,23 +549,28 @@ func getService(req *http.Request) (string, error) {
 	return service, nil
 }
 
-// getScopes will check for the scope GET parameter and verify if it's properly
-// formated as specified by the Docker Token Specification
+// getScopes will check for the scope GET parameters and verify if they are
+// properly formated as specified by the Docker Token Specification. The scope
+// parameter can be passed more than once, e.g. for cross repository blob mounts,
+// or hold a space separated list as in the OAuth2 form of the request.
 //
 // format: repository:namespace:privileges
 // example: repository:foo/bar:push,read
-func getScopes(req *http.Request) (*Scope, error) {
-	scope := req.FormValue("scope")
-	if scope == "" {
-		return nil, nil
+func getScopes(req *http.Request) ([]*Scope, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, HTTPBadRequest(err.Error())
 	}
 
-	s := &Scope{}
-	err := s.UnmarshalText([]byte(scope))
-	if err != nil || s.Actions.Has(PrivIllegal) {
-		return nil, HTTPBadRequest(err.Error())
+	var scopes []*Scope
+	for _, scope := range strings.Fields(strings.Join(req.Form["scope"], " ")) {
+		s := &Scope{}
+		err := s.UnmarshalText([]byte(scope))
+		if err != nil || s.Actions.Has(PrivIllegal) {
+			return nil, HTTPBadRequest(err.Error())
+		}
+		scopes = append(scopes, s)
 	}
-	return s, nil
+	return scopes, nil
 }
 
 func parseRequest(req *http.Request) (*AuthRequest, error) {
@@ -324,6 +598,6 @@ func parseRequest(req *http.Request) (*AuthRequest, error) {
 		Service:  service,
 		Account:  account,
 		Password: pass,
-		Scope:    scopes,
+		Scopes:   scopes,
 	}, nil
 }
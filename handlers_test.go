@@ -1,10 +1,127 @@
 package godoauth
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
+// fakeBackend is an in memory UserBackend used by the tests
+type fakeBackend struct {
+	users map[string]*UserInfo
+}
+
+func (b *fakeBackend) RetrieveUser(ctx context.Context, service, account string) (*UserInfo, error) {
+	user, ok := b.users[account]
+	if !ok {
+		return nil, ErrForbidden
+	}
+	return &UserInfo{
+		Username: user.Username,
+		Password: user.Password,
+		Access:   user.Access,
+	}, nil
+}
+
+func (b *fakeBackend) Authenticate(ctx context.Context, user *UserInfo, password string) (bool, error) {
+	return user.Password == password, nil
+}
+
+func (b *fakeBackend) Access(ctx context.Context, user *UserInfo) (map[string]Priv, error) {
+	return user.Access, nil
+}
+
+// newTestConfig returns a Config with a freshly generated token certificate
+// and key stored in dir.
+func newTestConfig(t testing.TB, dir string) *Config {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Token"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server.key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		HTTP: ServerConf{Timeout: 5 * time.Second},
+		Token: Token{
+			Issuer:      "Token",
+			Expiration:  800,
+			Certificate: certFile,
+			Key:         keyFile,
+		},
+	}
+	if err := config.LoadCerts(); err != nil {
+		t.Fatalf("error loading certs: %v", err)
+	}
+	return config
+}
+
+// tokenClaims decodes the claims of a JWT token without verifying it
+func tokenClaims(t *testing.T, token string) map[string]interface{} {
+	return tokenPart(t, token, 1)
+}
+
+// tokenHeader decodes the header of a JWT token
+func tokenHeader(t *testing.T, token string) map[string]interface{} {
+	return tokenPart(t, token, 0)
+}
+
+func tokenPart(t *testing.T, token string, i int) map[string]interface{} {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed token %q", token)
+	}
+	payload := parts[i]
+	if l := len(payload) % 4; l > 0 {
+		payload += strings.Repeat("=", 4-l)
+	}
+	b, err := base64.URLEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatalf("error decoding token: %v", err)
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(b, &claims); err != nil {
+		t.Fatalf("error unmarshalling token: %v", err)
+	}
+	return claims
+}
+
 func TestParseRequest(t *testing.T) {
 	invalidRequests := []string{
 		"/wrong",
@@ -44,8 +161,8 @@ func TestParseRequest(t *testing.T) {
 	if res.Password != "" {
 		t.Fatalf("Expected empty password, but received %s", res.Password)
 	}
-	if res.Scope != nil {
-		t.Fatalf("Expected empty scope, but received %v", res.Scope)
+	if len(res.Scopes) != 0 {
+		t.Fatalf("Expected empty scope, but received %v", res.Scopes)
 	}
 
 	req, _ = http.NewRequest("GET", "/?service=registry?account=foo", nil)
@@ -54,6 +171,25 @@ func TestParseRequest(t *testing.T) {
 		t.Fatalf("Valid request %s failed", req.URL.RequestURI())
 	}
 
+	req, _ = http.NewRequest("GET", "/?service=registry&scope=repository:foo/bar:push,pull&scope=repository:foo/baz:pull", nil)
+	res, err = parseRequest(req)
+	if err != nil {
+		t.Fatalf("Valid request %s failed", req.URL.RequestURI())
+	}
+	if len(res.Scopes) != 2 {
+		t.Fatalf("Expected 2 scopes, but received %v", res.Scopes)
+	}
+	if res.Scopes[0].Name != "foo/bar" || res.Scopes[0].Actions != PrivPush|PrivPull {
+		t.Fatalf("Expected foo/bar with privilege Push and Pull, but received %v", res.Scopes[0])
+	}
+	if res.Scopes[1].Name != "foo/baz" || res.Scopes[1].Actions != PrivPull {
+		t.Fatalf("Expected foo/baz with privilege Pull, but received %v", res.Scopes[1])
+	}
+
+	req, _ = http.NewRequest("GET", "/?service=registry&scope=repository:foo/bar:pull&scope=foo/baz:pull", nil)
+	if _, err = parseRequest(req); err == nil {
+		t.Fatalf("Invalid request %s didn't fail", req.URL.RequestURI())
+	}
 }
 
 func TestPrivileges(t *testing.T) {
@@ -118,6 +254,26 @@ func TestPrivileges(t *testing.T) {
 			PrivIllegal,
 			true,
 		},
+		{
+			"delete,pull",
+			PrivDelete | PrivPull,
+			true,
+		},
+		{
+			"push,pull",
+			PrivDelete,
+			false,
+		},
+		{
+			"*",
+			PrivAll,
+			true,
+		},
+		{
+			"pull,wrong",
+			PrivIllegal,
+			true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -128,6 +284,34 @@ func TestPrivileges(t *testing.T) {
 	}
 }
 
+func TestPrivActions(t *testing.T) {
+	tests := []struct {
+		in  string
+		out []string
+	}{
+		{"pull", []string{"pull"}},
+		{"delete,pull,push", []string{"push", "pull", "delete"}},
+		{"pull,delete", []string{"pull", "delete"}},
+		{"*", []string{"push", "pull", "delete"}},
+	}
+
+	for _, tt := range tests {
+		p := NewPriv(tt.in)
+		if !p.Valid() {
+			t.Errorf("NewPriv(%q) = %v is not valid", tt.in, p)
+		}
+		if !reflect.DeepEqual(p.Actions(), tt.out) {
+			t.Errorf("NewPriv(%q).Actions() = %v, expected %v", tt.in, p.Actions(), tt.out)
+		}
+	}
+
+	for _, in := range []string{"", "pull,", "wrong", "pull,push,wrong"} {
+		if NewPriv(in).Valid() {
+			t.Errorf("NewPriv(%q) should not be valid", in)
+		}
+	}
+}
+
 func TestActionAllowed(t *testing.T) {
 
 	accessMap := make(map[string]Priv)
@@ -177,6 +361,37 @@ func TestActionAllowed(t *testing.T) {
 		t.Fatalf("Expected foo/bar with privilege Push, but received %v", scope)
 	}
 
+	reqscope = &Scope{
+		Type:    "registry",
+		Name:    "catalog",
+		Actions: PrivAll,
+	}
+
+	accessMap["*"] = PrivAll
+	scope = actionAllowed(reqscope, vuser)
+	if scope.Type != "" {
+		t.Fatalf("Expected no catalog access from repository patterns, but received %v", scope)
+	}
+
+	accessMap["registry:catalog"] = PrivAll
+	scope = actionAllowed(reqscope, vuser)
+	if scope.Type != "registry" || scope.Name != "catalog" || scope.Actions != PrivAll {
+		t.Fatalf("Expected registry catalog with privilege All, but received %v", scope)
+	}
+
+	reqscope = &Scope{
+		Type:    "repository",
+		Class:   "plugin",
+		Name:    "vieux/sshfs",
+		Actions: PrivAll,
+	}
+
+	accessMap["vieux/*"] = PrivPull
+	scope = actionAllowed(reqscope, vuser)
+	if scope.Class != "plugin" || scope.Name != "vieux/sshfs" || scope.Actions != PrivPull {
+		t.Fatalf("Expected plugin vieux/sshfs with privilege Pull, but received %v", scope)
+	}
+
 }
 
 func TestScopeUnmarshalText(t *testing.T) {
@@ -186,6 +401,9 @@ func TestScopeUnmarshalText(t *testing.T) {
 		"repository:namespace:wrong",
 		"something:bla/bla:push",
 		"push:alpine/master:pull",
+		"repository::pull",
+		"repository():foo/bar:pull",
+		"registry(plugin):catalog:*",
 	}
 	for _, v := range invalidFormats {
 		s := &Scope{}
@@ -230,6 +448,31 @@ func TestScopeUnmarshalText(t *testing.T) {
 				Actions: PrivPush,
 			},
 		},
+		{
+			"repository:localhost:5000/golja/godoauth:pull",
+			Scope{
+				Type:    "repository",
+				Name:    "localhost:5000/golja/godoauth",
+				Actions: PrivPull,
+			},
+		},
+		{
+			"repository(plugin):vieux/sshfs:pull",
+			Scope{
+				Type:    "repository",
+				Class:   "plugin",
+				Name:    "vieux/sshfs",
+				Actions: PrivPull,
+			},
+		},
+		{
+			"registry:catalog:*",
+			Scope{
+				Type:    "registry",
+				Name:    "catalog",
+				Actions: PrivAll,
+			},
+		},
 	}
 
 	for _, v := range validFormats {
@@ -242,3 +485,350 @@ func TestScopeUnmarshalText(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenAuthHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &TokenAuthHandler{
+		Config: newTestConfig(t, dir),
+		Backend: &fakeBackend{
+			users: map[string]*UserInfo{
+				"foo": {
+					Username: "foo",
+					Password: "bar",
+					Access:   map[string]Priv{"foo/bar": PrivAll, "foo/baz": PrivPull},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		user, pass string
+		code       int
+	}{
+		{"foo", "bar", http.StatusOK},
+		{"foo", "wrong", http.StatusForbidden},
+		{"bar", "foo", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/auth?service=registry&scope=repository:foo/bar:push&scope=repository:foo/baz:push,pull&scope=repository:zala/srot:pull", nil)
+		req.SetBasicAuth(tt.user, tt.pass)
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, req)
+		if response.Code != tt.code {
+			t.Errorf("GET /auth as %s:%s got %v, expected %v", tt.user, tt.pass, response.Code, tt.code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/auth?service=registry&scope=repository:foo/bar:push&scope=repository:foo/baz:push,pull&scope=repository:zala/srot:pull", nil)
+	req.SetBasicAuth("foo", "bar")
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, req)
+
+	respData := tokenResponse{}
+	if err := json.Unmarshal(response.Body.Bytes(), &respData); err != nil {
+		t.Fatalf("error unmarshalling JSON response: %v", err)
+	}
+
+	claims := tokenClaims(t, respData.Token)
+	access, _ := json.Marshal(claims["access"])
+	expected := `[{"actions":["push"],"name":"foo/bar","type":"repository"},{"actions":["pull"],"name":"foo/baz","type":"repository"}]`
+	if string(access) != expected {
+		t.Errorf("access claim = %s, expected %s", access, expected)
+	}
+	if claims["sub"] != "foo" || claims["aud"] != "registry" || claims["iss"] != "Token" {
+		t.Errorf("unexpected token claims %v", claims)
+	}
+
+	if respData.AccessToken != respData.Token {
+		t.Errorf("access_token %q differs from token %q", respData.AccessToken, respData.Token)
+	}
+	issuedAt, err := time.Parse(time.RFC3339, respData.IssuedAt)
+	if err != nil {
+		t.Fatalf("invalid issued_at %q: %v", respData.IssuedAt, err)
+	}
+	if iat := int64(claims["iat"].(float64)); issuedAt.Unix() != iat {
+		t.Errorf("issued_at = %v, expected iat claim %d", issuedAt.Unix(), iat)
+	}
+	if exp := int64(claims["exp"].(float64)); issuedAt.Unix()+respData.ExpiresIn != exp {
+		t.Errorf("issued_at + expires_in = %d, expected exp claim %d", issuedAt.Unix()+respData.ExpiresIn, exp)
+	}
+}
+
+func TestCreateToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &TokenAuthHandler{Config: newTestConfig(t, dir)}
+	token, err := h.CreateToken(nil, "registry", "foo")
+	if err != nil {
+		t.Fatalf("CreateToken() failed: %v", err)
+	}
+
+	claims := tokenClaims(t, token.Token)
+	if _, ok := claims["access"]; ok {
+		t.Errorf("unexpected access claim %v", claims["access"])
+	}
+	if claims["jti"] != token.ID {
+		t.Errorf("jti claim = %v, expected %s", claims["jti"], token.ID)
+	}
+	if iat := int64(claims["iat"].(float64)); iat != token.IssuedAt.Unix() {
+		t.Errorf("iat claim = %d, expected %d", iat, token.IssuedAt.Unix())
+	}
+	if exp := int64(claims["exp"].(float64)); exp != token.ExpiresAt.Unix() {
+		t.Errorf("exp claim = %d, expected %d", exp, token.ExpiresAt.Unix())
+	}
+	if token.ExpiresIn() != 800 {
+		t.Errorf("ExpiresIn() = %d, expected 800", token.ExpiresIn())
+	}
+
+	// the key is only read when loading the config
+	if err := os.Remove(h.Config.Token.Key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.CreateToken(nil, "registry", "foo"); err != nil {
+		t.Errorf("CreateToken() without key file failed: %v", err)
+	}
+
+	if _, err := (&TokenAuthHandler{Config: &Config{}}).CreateToken(nil, "registry", "foo"); err == nil {
+		t.Errorf("expected error without signing key")
+	}
+}
+
+func TestTokenAuthHandlerAnonymous(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &TokenAuthHandler{
+		Config: newTestConfig(t, dir),
+		Backend: &fakeBackend{
+			users: map[string]*UserInfo{
+				"foo": {
+					Username: "foo",
+					Password: "bar",
+					Access:   map[string]Priv{"foo/bar": PrivAll},
+				},
+			},
+		},
+	}
+
+	// without public repositories anonymous requests are unauthorized
+	req, _ := http.NewRequest("GET", "/auth?service=registry&scope=repository:library/busybox:pull", nil)
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, req)
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous GET /auth got %v, expected %v", response.Code, http.StatusUnauthorized)
+	}
+
+	h.Config.Anonymous.Repositories = []string{"library/*", "public"}
+
+	tests := []struct {
+		user, scope, access string
+	}{
+		{"", "repository:library/busybox:pull", `[{"actions":["pull"],"name":"library/busybox","type":"repository"}]`},
+		{"", "repository:library/busybox:push,pull", `[{"actions":["pull"],"name":"library/busybox","type":"repository"}]`},
+		{"", "repository:public:pull", `[{"actions":["pull"],"name":"public","type":"repository"}]`},
+		{"", "repository:library/busybox:push", `null`},
+		{"", "repository:foo/bar:pull", `null`},
+		{"", "repository:library/foo/bar:pull", `[{"actions":["pull"],"name":"library/foo/bar","type":"repository"}]`},
+		{"", "repository:publicity:pull", `null`},
+		{"foo", "repository:library/busybox:pull", `[{"actions":["pull"],"name":"library/busybox","type":"repository"}]`},
+		{"foo", "repository:foo/bar:push,pull", `[{"actions":["push","pull"],"name":"foo/bar","type":"repository"}]`},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/auth?service=registry&scope="+tt.scope, nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, "bar")
+		}
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, req)
+		if response.Code != http.StatusOK {
+			t.Errorf("GET /auth for %q as %q got %v, expected %v", tt.scope, tt.user, response.Code, http.StatusOK)
+			continue
+		}
+
+		respData := struct {
+			Token string `json:"token"`
+		}{}
+		if err := json.Unmarshal(response.Body.Bytes(), &respData); err != nil {
+			t.Fatalf("error unmarshalling JSON response: %v", err)
+		}
+		access, _ := json.Marshal(tokenClaims(t, respData.Token)["access"])
+		if string(access) != tt.access {
+			t.Errorf("access claim for %q as %q = %s, expected %s", tt.scope, tt.user, access, tt.access)
+		}
+	}
+}
+
+// fakeGroupBackend is a fakeBackend also storing groups
+type fakeGroupBackend struct {
+	fakeBackend
+	groups map[string]map[string]Priv
+}
+
+func (b *fakeGroupBackend) RetrieveGroup(ctx context.Context, service, group string) (map[string]Priv, error) {
+	return b.groups[group], nil
+}
+
+func TestResolveGroups(t *testing.T) {
+	h := &TokenAuthHandler{
+		Config: &Config{
+			Groups: map[string]Group{
+				"admins": {Members: []string{"foo"}, Access: "repository:*:*"},
+				"team-a": {Access: "repository:team-a/*:pull"},
+			},
+		},
+		Backend: &fakeGroupBackend{
+			groups: map[string]map[string]Priv{
+				"team-a": {"team-a/*": PrivAll},
+				"team-b": {"team-b/*": PrivPush},
+			},
+		},
+	}
+
+	user := &UserInfo{Username: "foo", Groups: []string{"team-a", "team-b", "unknown"}}
+	if err := h.resolveGroups(context.Background(), "registry", user); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(user.Groups, []string{"team-a", "team-b", "unknown", "admins"}) {
+		t.Errorf("unexpected groups %v", user.Groups)
+	}
+	expected := map[string]map[string]Priv{
+		"admins":  {"*": PrivPush | PrivPull},
+		"team-a":  {"team-a/*": PrivPull},
+		"team-b":  {"team-b/*": PrivPush},
+		"unknown": nil,
+	}
+	if !reflect.DeepEqual(user.GroupAccess, expected) {
+		t.Errorf("GroupAccess = %v, expected %v", user.GroupAccess, expected)
+	}
+
+	// without a GroupBackend only the config file groups are known
+	h.Backend = &fakeBackend{}
+	user = &UserInfo{Username: "bar", Groups: []string{"team-a", "team-b"}}
+	if err := h.resolveGroups(context.Background(), "registry", user); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected = map[string]map[string]Priv{"team-a": {"team-a/*": PrivPull}}
+	if !reflect.DeepEqual(user.GroupAccess, expected) {
+		t.Errorf("GroupAccess = %v, expected %v", user.GroupAccess, expected)
+	}
+	if user.Priv("team-a/app") != PrivPull || user.Priv("team-b/app") != 0 {
+		t.Errorf("unexpected privileges for bar %v", user.GroupAccess)
+	}
+}
+
+func TestTokenAuthHandlerCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	access, _ := parseAccess("registry:catalog:*;repository:*:pull")
+	h := &TokenAuthHandler{
+		Config: newTestConfig(t, dir),
+		Backend: &fakeBackend{
+			users: map[string]*UserInfo{
+				"admin": {Username: "admin", Password: "bar", Access: access},
+				"foo":   {Username: "foo", Password: "bar", Access: map[string]Priv{"*": PrivPull}},
+			},
+		},
+	}
+
+	tests := []struct {
+		user, access string
+	}{
+		{"admin", `[{"actions":["*"],"name":"catalog","type":"registry"},{"actions":["pull"],"class":"plugin","name":"vieux/sshfs","type":"repository"}]`},
+		{"foo", `[{"actions":["pull"],"class":"plugin","name":"vieux/sshfs","type":"repository"}]`},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/auth?service=registry&scope=registry:catalog:*&scope=repository(plugin):vieux/sshfs:pull", nil)
+		req.SetBasicAuth(tt.user, "bar")
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, req)
+		if response.Code != http.StatusOK {
+			t.Fatalf("GET /auth as %s got %v, expected %v", tt.user, response.Code, http.StatusOK)
+		}
+
+		respData := struct {
+			Token string `json:"token"`
+		}{}
+		if err := json.Unmarshal(response.Body.Bytes(), &respData); err != nil {
+			t.Fatalf("error unmarshalling JSON response: %v", err)
+		}
+		access, _ := json.Marshal(tokenClaims(t, respData.Token)["access"])
+		if string(access) != tt.access {
+			t.Errorf("access claim as %s = %s, expected %s", tt.user, access, tt.access)
+		}
+	}
+}
+
+func BenchmarkCreateToken(b *testing.B) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &TokenAuthHandler{Config: newTestConfig(b, dir)}
+	scopes := []*Scope{{Type: "repository", Name: "foo/bar", Actions: PrivPull}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.CreateToken(scopes, "registry", "foo"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTokenAuthHandlerVault measures concurrent /auth requests against
+// a Vault backend, the connections to Vault are reported as conns
+func BenchmarkTokenAuthHandlerVault(b *testing.B) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var conns int64
+	ts, vaultConfig := startTestVault(b, map[string]string{"/v1/registry/foo": vaultReturnV_1}, &conns)
+	defer ts.Close()
+	vaultConfig.Pool = 10
+	vaultConfig.PlaintextPasswords = true
+
+	config := newTestConfig(b, dir)
+	config.Storage.Vault = *vaultConfig
+	backend, err := NewUserBackend(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	h := &TokenAuthHandler{Config: config, Backend: backend}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req, _ := http.NewRequest("GET", "/auth?service=registry&scope=repository:foo/bar:pull", nil)
+			req.SetBasicAuth("foo", "bar")
+			response := httptest.NewRecorder()
+			h.ServeHTTP(response, req)
+			if response.Code != http.StatusOK {
+				b.Errorf("GET /auth got %v", response.Code)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(atomic.LoadInt64(&conns)), "conns")
+}
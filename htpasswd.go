@@ -0,0 +1,200 @@
+package godoauth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// HtpasswdBackend is the UserBackend reading the users from an Apache
+// htpasswd file and their access from a separate ACL file. Both files are
+// reloaded as soon as they change on disk. The service is ignored, every
+// user has the same access to all services.
+type HtpasswdBackend struct {
+	Config *Htpasswd
+
+	mu      sync.RWMutex
+	users   map[string]string
+	access  map[string]map[string]Priv
+	modTime map[string]time.Time
+}
+
+// NewHtpasswdBackend returns a new HtpasswdBackend with the htpasswd
+// and ACL files already loaded.
+func NewHtpasswdBackend(c *Htpasswd) (*HtpasswdBackend, error) {
+	b := &HtpasswdBackend{
+		Config:  c,
+		modTime: make(map[string]time.Time),
+	}
+	if err := b.reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// changed reports if the file was modified since it was last loaded
+func (b *HtpasswdBackend) changed(path string) (bool, error) {
+	if path == "" {
+		return false, nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return !fi.ModTime().Equal(b.modTime[path]), nil
+}
+
+// reload reads the htpasswd and ACL files again if any of them changed
+func (b *HtpasswdBackend) reload() error {
+	usersChanged, err := b.changed(b.Config.Path)
+	if err != nil {
+		return err
+	}
+	aclChanged, err := b.changed(b.Config.ACL)
+	if err != nil {
+		return err
+	}
+	if !usersChanged && !aclChanged {
+		return nil
+	}
+
+	users := make(map[string]string)
+	usersTime, err := readFile(b.Config.Path, func(r io.Reader) error {
+		return parseHtpasswd(r, users)
+	})
+	if err != nil {
+		return err
+	}
+
+	access := make(map[string]map[string]Priv)
+	var aclTime time.Time
+	if b.Config.ACL != "" {
+		aclTime, err = readFile(b.Config.ACL, func(r io.Reader) error {
+			return parseACL(r, access)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.users = users
+	b.access = access
+	b.modTime[b.Config.Path] = usersTime
+	if b.Config.ACL != "" {
+		b.modTime[b.Config.ACL] = aclTime
+	}
+	return nil
+}
+
+// readFile opens the file, passes it to parse and returns the modification
+// time of the parsed content
+func readFile(path string, parse func(io.Reader) error) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := parse(f); err != nil {
+		return time.Time{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return fi.ModTime(), nil
+}
+
+// parseHtpasswd reads the user:hash entries of a htpasswd file
+func parseHtpasswd(r io.Reader, users map[string]string) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i <= 0 {
+			return fmt.Errorf("malformed entry on line %d", line)
+		}
+		users[text[:i]] = text[i+1:]
+	}
+	return scanner.Err()
+}
+
+// parseACL reads the ACL file which contains one user per line followed
+// by the access list in the same format as stored in Vault
+//
+// example: foo repository:foo/bar:*;repository:linux/db:pull
+func parseACL(r io.Reader, access map[string]map[string]Priv) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("malformed entry on line %d", line)
+		}
+		userAccess, err := parseAccess(fields[1])
+		if err != nil {
+			return fmt.Errorf("malformed access on line %d", line)
+		}
+		if access[fields[0]] == nil {
+			access[fields[0]] = make(map[string]Priv)
+		}
+		for name, p := range userAccess {
+			access[fields[0]][name] |= p
+		}
+	}
+	return scanner.Err()
+}
+
+// RetrieveUser looks up the account in the htpasswd file
+func (b *HtpasswdBackend) RetrieveUser(ctx context.Context, service, account string) (*UserInfo, error) {
+	if err := b.reload(); err != nil {
+		ctxLogger(ctx).Warnf("error reloading htpasswd backend, using previous data: %v", err)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	hash, ok := b.users[account]
+	if !ok {
+		return nil, ErrForbidden
+	}
+	access := make(map[string]Priv)
+	for name, p := range b.access[account] {
+		access[name] = p
+	}
+	return &UserInfo{
+		Username: account,
+		Password: hash,
+		Access:   access,
+	}, nil
+}
+
+// Authenticate checks the password against the hash from the htpasswd file
+func (b *HtpasswdBackend) Authenticate(ctx context.Context, user *UserInfo, password string) (bool, error) {
+	ok, err := checkPassword(user.Password, password, false)
+	if err != nil {
+		ctxLogger(ctx).Warnf("error checking password of user %s: %v", user.Username, err)
+		return false, nil
+	}
+	return ok, nil
+}
+
+// Access returns the access list of the user from the ACL file
+func (b *HtpasswdBackend) Access(ctx context.Context, user *UserInfo) (map[string]Priv, error) {
+	return user.Access, nil
+}
@@ -0,0 +1,126 @@
+package godoauth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
+)
+
+func writeHtpasswdFiles(t *testing.T, dir, users, acl string, mtime time.Time) *Htpasswd {
+	c := &Htpasswd{
+		Path: filepath.Join(dir, "htpasswd"),
+		ACL:  filepath.Join(dir, "acl"),
+	}
+	if err := ioutil.WriteFile(c.Path, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.ACL, []byte(acl), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// force a different modification time, the file system resolution
+	// may be too coarse to notice the change otherwise
+	os.Chtimes(c.Path, mtime, mtime)
+	os.Chtimes(c.ACL, mtime, mtime)
+	return c
+}
+
+func TestHtpasswdBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("bar"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := "# comment\nfoo:" + string(hash) + "\n" +
+		// echo -n foo | openssl dgst -sha1 -binary | base64
+		"bar:{SHA}C+7Hteo/D9vJXQ3UfzxbwnXaijM=\n"
+	acl := "foo repository:foo/bar:*;repository:linux/db:pull\nfoo repository:linux/db:push\n"
+
+	c := writeHtpasswdFiles(t, dir, users, acl, time.Now().Add(-time.Hour))
+	b, err := NewHtpasswdBackend(c)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ctx := context.Background()
+	tests := []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"foo", "bar", true},
+		{"foo", "wrong", false},
+		{"bar", "foo", true},
+		{"bar", "bar", false},
+	}
+	for _, tt := range tests {
+		user, err := b.RetrieveUser(ctx, "registry", tt.user)
+		if err != nil {
+			t.Fatalf("RetrieveUser(%q) unexpected error %v", tt.user, err)
+		}
+		ok, err := b.Authenticate(ctx, user, tt.pass)
+		if err != nil || ok != tt.ok {
+			t.Errorf("Authenticate(%q, %q) = %v, %v, expected %v", tt.user, tt.pass, ok, err, tt.ok)
+		}
+	}
+
+	// like Vault, a password which cannot be checked is refused
+	if ok, err := b.Authenticate(ctx, &UserInfo{Username: "foo", Password: "bar"}, "bar"); ok || err != nil {
+		t.Errorf("Authenticate with plaintext password = %v, %v, expected false", ok, err)
+	}
+
+	if _, err := b.RetrieveUser(ctx, "registry", "unknown"); err != ErrForbidden {
+		t.Errorf("Expected ErrForbidden for unknown user, but received %v", err)
+	}
+
+	user, _ := b.RetrieveUser(ctx, "registry", "foo")
+	access, err := b.Access(ctx, user)
+	expected := map[string]Priv{"foo/bar": PrivPush | PrivPull, "linux/db": PrivPush | PrivPull}
+	if err != nil || !reflect.DeepEqual(access, expected) {
+		t.Errorf("Access() = %v, %v, expected %v", access, err, expected)
+	}
+
+	user, _ = b.RetrieveUser(ctx, "registry", "bar")
+	if len(user.Access) != 0 {
+		t.Errorf("Expected empty access for bar, but received %v", user.Access)
+	}
+
+	// rewrite the files and check the backend picked up the change
+	writeHtpasswdFiles(t, dir, "bar:{SHA}C+7Hteo/D9vJXQ3UfzxbwnXaijM=\n", "bar repository:bar/foo:pull\n", time.Now())
+	if _, err := b.RetrieveUser(ctx, "registry", "foo"); err != ErrForbidden {
+		t.Errorf("Expected ErrForbidden for removed user, but received %v", err)
+	}
+	user, err = b.RetrieveUser(ctx, "registry", "bar")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(user.Access, map[string]Priv{"bar/foo": PrivPull}) {
+		t.Errorf("Expected reloaded access for bar, but received %v", user.Access)
+	}
+}
+
+func TestHtpasswdBackendInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewHtpasswdBackend(&Htpasswd{Path: filepath.Join(dir, "missing")}); err == nil {
+		t.Errorf("Expected error for missing htpasswd file")
+	}
+
+	c := writeHtpasswdFiles(t, dir, "foo:{SHA}C+7Hteo/D9vJXQ3UfzxbwnXaijM=\n", "foo foo/bar:*\n", time.Now())
+	if _, err := NewHtpasswdBackend(c); err == nil {
+		t.Errorf("Expected error for malformed ACL file")
+	}
+}
@@ -0,0 +1,95 @@
+package godoauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/docker/libtrust"
+)
+
+// jwksPath is where the token verification keys are published
+const jwksPath = "/.well-known/jwks.json"
+
+// jwksMaxAge is how long the key set may be cached, a rotated key is
+// published that long before it signs
+const jwksMaxAge = 5 * time.Minute
+
+// ServeJWKS publishes the token verification keys as a JSON Web Key Set, the
+// kid of every key is the libtrust key ID used in the token header.
+func (h *TokenAuthHandler) ServeJWKS(w http.ResponseWriter, r *http.Request) {
+	jwks := struct {
+		Keys []libtrust.PublicKey `json:"keys"`
+	}{
+		Keys: h.keyring().PublicKeys(),
+	}
+	if jwks.Keys == nil {
+		jwks.Keys = []libtrust.PublicKey{}
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	writeJSON(w, jwks)
+}
+
+// ServeOpenIDConfiguration publishes an OpenID style discovery document
+// pointing to the token and key set endpoints of the external_url, or of the
+// request host if it is not configured. The document built from the request
+// headers must not be kept by shared caches.
+func (h *TokenAuthHandler) ServeOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	base := h.Config.HTTP.ExternalURL
+	if base != "" {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	} else {
+		base = baseURL(r)
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+
+	var algs []string
+	for _, key := range h.keyring().PublicKeys() {
+		if alg, ok := key.GetExtendedField("alg").(string); ok && !containsString(algs, alg) {
+			algs = append(algs, alg)
+		}
+	}
+
+	writeJSON(w, struct {
+		Issuer              string   `json:"issuer"`
+		TokenEndpoint       string   `json:"token_endpoint"`
+		RevocationEndpoint  string   `json:"revocation_endpoint"`
+		JWKSURI             string   `json:"jwks_uri"`
+		GrantTypes          []string `json:"grant_types_supported"`
+		ResponseTypes       []string `json:"response_types_supported"`
+		SubjectTypes        []string `json:"subject_types_supported"`
+		IDTokenSigningAlgos []string `json:"id_token_signing_alg_values_supported"`
+	}{
+		Issuer:              h.Config.Token.Issuer,
+		TokenEndpoint:       base + "/token",
+		RevocationEndpoint:  base + "/token/revoke",
+		JWKSURI:             base + jwksPath,
+		GrantTypes:          []string{"password", "refresh_token"},
+		ResponseTypes:       []string{"token"},
+		SubjectTypes:        []string{"public"},
+		IDTokenSigningAlgos: algs,
+	})
+}
+
+// baseURL returns the scheme and host the request has been sent to
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,122 @@
+package godoauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/docker/libtrust"
+)
+
+func TestHandlerJWKS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	authHandler := &TokenAuthHandler{Config: newTestConfig(t, dir)}
+	s := NewHandler(authHandler)
+
+	request, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	response := httptest.NewRecorder()
+	s.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("GET /.well-known/jwks.json got %v, expected %v", response.Code, http.StatusOK)
+	}
+
+	keys, err := libtrust.UnmarshalPublicKeyJWKSet(response.Body.Bytes())
+	if err != nil {
+		t.Fatalf("error unmarshalling JWK set: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("Expected 1 key, but received %d", len(keys))
+	}
+	if alg := keys[0].GetExtendedField("alg"); alg != "RS256" {
+		t.Errorf("alg = %v, expected RS256", alg)
+	}
+
+	// the published key must verify the tokens signed by the handler
+	token, err := authHandler.CreateToken(nil, "registry", "foo")
+	if err != nil {
+		t.Fatalf("CreateToken() failed: %v", err)
+	}
+	parts := strings.Split(token.Token, ".")
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	b, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if err := json.Unmarshal(b, &header); err != nil {
+		t.Fatalf("error unmarshalling token header: %v", err)
+	}
+	if header.Kid != keys[0].KeyID() {
+		t.Errorf("token kid = %q, expected %q", header.Kid, keys[0].KeyID())
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if err := keys[0].Verify(strings.NewReader(parts[0]+"."+parts[1]), header.Alg, sig); err != nil {
+		t.Errorf("token signature not verified by the published key: %v", err)
+	}
+}
+
+func TestHandlerOpenIDConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &TokenAuthHandler{Config: newTestConfig(t, dir)}
+	s := NewHandler(h)
+
+	request, _ := http.NewRequest("GET", "https://auth.example.com/.well-known/openid-configuration", nil)
+	request.Header.Set("X-Forwarded-Proto", "https")
+	response := httptest.NewRecorder()
+	s.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("GET /.well-known/openid-configuration got %v, expected %v", response.Code, http.StatusOK)
+	}
+
+	respData := struct {
+		Issuer  string   `json:"issuer"`
+		JWKSURI string   `json:"jwks_uri"`
+		Algs    []string `json:"id_token_signing_alg_values_supported"`
+	}{}
+	if err := json.Unmarshal(response.Body.Bytes(), &respData); err != nil {
+		t.Fatalf("error unmarshalling JSON response: %v", err)
+	}
+	if respData.Issuer != "Token" {
+		t.Errorf("issuer = %q, expected Token", respData.Issuer)
+	}
+	if expected := "https://auth.example.com/.well-known/jwks.json"; respData.JWKSURI != expected {
+		t.Errorf("jwks_uri = %q, expected %q", respData.JWKSURI, expected)
+	}
+	if len(respData.Algs) != 1 || respData.Algs[0] != "RS256" {
+		t.Errorf("signing algorithms = %v, expected [RS256]", respData.Algs)
+	}
+	// built from the request headers, shared caches must not keep it
+	if cc := response.Header().Get("Cache-Control"); strings.Contains(cc, "public") {
+		t.Errorf("Cache-Control = %q, expected a private response", cc)
+	}
+
+	// the external_url is used whatever the request headers
+	h.Config.HTTP.ExternalURL = "https://auth.example.com"
+	request, _ = http.NewRequest("GET", "http://evil.example.com/.well-known/openid-configuration", nil)
+	request.Header.Set("X-Forwarded-Proto", "http")
+	response = httptest.NewRecorder()
+	s.ServeHTTP(response, request)
+	if err := json.Unmarshal(response.Body.Bytes(), &respData); err != nil {
+		t.Fatalf("error unmarshalling JSON response: %v", err)
+	}
+	if expected := "https://auth.example.com/.well-known/jwks.json"; respData.JWKSURI != expected {
+		t.Errorf("jwks_uri = %q, expected %q", respData.JWKSURI, expected)
+	}
+	if cc := response.Header().Get("Cache-Control"); cc != "public, max-age=300" {
+		t.Errorf("Cache-Control = %q, expected public, max-age=300", cc)
+	}
+}
@@ -0,0 +1,163 @@
+package godoauth
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/docker/libtrust"
+)
+
+// Keyring holds the key signing the new tokens and the previous signing keys,
+// which stay published for verification until the tokens they signed have
+// expired. A new signing key is published jwksMaxAge before it signs, so the
+// verifiers caching the key set know it by then.
+type Keyring struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	signing  signingKey
+	pending  *pendingKey
+	previous []retiredKey
+	// published for verification as long as they are in the config
+	configured []libtrust.PublicKey
+}
+
+// signingKey is the key pair signing the new tokens
+type signingKey struct {
+	publicKey  libtrust.PublicKey
+	privateKey libtrust.PrivateKey
+	alg        string
+	lifetime   time.Duration
+}
+
+// retiredKey is a previous signing key kept until expires
+type retiredKey struct {
+	publicKey libtrust.PublicKey
+	expires   time.Time
+}
+
+// pendingKey is a new signing key published until it signs from activates
+type pendingKey struct {
+	key       signingKey
+	activates time.Time
+}
+
+// NewKeyring returns a new Keyring signing with the key of the token config,
+// the config certificates must have been loaded.
+func NewKeyring(t *Token) *Keyring {
+	k := &Keyring{now: time.Now}
+	k.signing, k.configured = newSigningKey(t), t.previousKeys
+	return k
+}
+
+func newSigningKey(t *Token) signingKey {
+	return signingKey{
+		publicKey:  t.publicKey,
+		privateKey: t.privateKey,
+		alg:        t.signingAlg,
+		lifetime:   time.Duration(t.Expiration) * time.Second,
+	}
+}
+
+// sign returns the signed token, the key stays in memory and is not read
+// again from the key file
+func (k signingKey) sign(token *jwt.Token) (string, error) {
+	ss, err := token.SigningString()
+	if err != nil {
+		return "", err
+	}
+	sig, alg, err := k.privateKey.Sign(strings.NewReader(ss), 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign: %s", err)
+	}
+	if alg != k.alg {
+		return "", fmt.Errorf("key signed with %s instead of %s", alg, k.alg)
+	}
+	return ss + "." + jwt.EncodeSegment(sig), nil
+}
+
+// Rotate publishes the key of the token config, it becomes the signing key
+// once the verifiers have had jwksMaxAge to fetch it. The current signing key
+// stays published until the tokens it signed have expired.
+func (k *Keyring) Rotate(t *Token) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := newSigningKey(t)
+	k.configured = t.previousKeys
+	switch {
+	case k.signing.publicKey == nil:
+		k.signing = key
+	case k.signing.publicKey.KeyID() == key.publicKey.KeyID():
+		k.signing, k.pending = key, nil
+	case k.pending != nil && k.pending.key.publicKey.KeyID() == key.publicKey.KeyID():
+		k.pending.key = key
+	default:
+		// a pending key being replaced has not signed anything yet
+		k.pending = &pendingKey{key: key, activates: k.now().Add(jwksMaxAge)}
+	}
+}
+
+// promote makes the pending key the signing key once it is due, k.mu must
+// be held
+func (k *Keyring) promote() {
+	now := k.now()
+	if k.pending == nil || now.Before(k.pending.activates) {
+		return
+	}
+	k.previous = append(k.previous, retiredKey{
+		publicKey: k.signing.publicKey,
+		expires:   now.Add(k.signing.lifetime),
+	})
+	k.signing, k.pending = k.pending.key, nil
+}
+
+// signingKey returns the key signing the new tokens
+func (k *Keyring) signingKey() signingKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.promote()
+	return k.signing
+}
+
+// PublicKeys returns the keys the tokens can be verified with, the signing
+// key comes first, followed by the pending one. Expired previous keys are
+// dropped.
+func (k *Keyring) PublicKeys() []libtrust.PublicKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.promote()
+	now := k.now()
+	previous := k.previous[:0]
+	for _, key := range k.previous {
+		if now.Before(key.expires) {
+			previous = append(previous, key)
+		}
+	}
+	k.previous = previous
+
+	var keys []libtrust.PublicKey
+	seen := make(map[string]bool)
+	add := func(key libtrust.PublicKey) {
+		if key != nil && !seen[key.KeyID()] {
+			seen[key.KeyID()] = true
+			keys = append(keys, key)
+		}
+	}
+	add(k.signing.publicKey)
+	if k.pending != nil {
+		add(k.pending.key.publicKey)
+	}
+	for i := len(k.previous) - 1; i >= 0; i-- {
+		add(k.previous[i].publicKey)
+	}
+	for _, key := range k.configured {
+		add(key)
+	}
+	return keys
+}
@@ -0,0 +1,124 @@
+package godoauth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/libtrust"
+)
+
+func keyIDs(keys []libtrust.PublicKey) []string {
+	var ids []string
+	for _, key := range keys {
+		ids = append(ids, key.KeyID())
+	}
+	return ids
+}
+
+func TestKeyringRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldConfig := newTestConfig(t, filepath.Join(dir, "old"))
+	newConfig := newTestConfig(t, filepath.Join(dir, "new"))
+	oldID, newID := oldConfig.Token.publicKey.KeyID(), newConfig.Token.publicKey.KeyID()
+
+	keys := NewKeyring(&oldConfig.Token)
+	now := time.Now()
+	keys.now = func() time.Time { return now }
+	h := &TokenAuthHandler{Config: oldConfig, Keys: keys}
+
+	token, err := h.CreateToken(nil, "registry", "foo")
+	if err != nil {
+		t.Fatalf("CreateToken() failed: %v", err)
+	}
+	if kid := tokenHeader(t, token.Token)["kid"]; kid != oldID {
+		t.Errorf("kid = %v, expected %s", kid, oldID)
+	}
+
+	// the new key is published before it signs
+	keys.Rotate(&newConfig.Token)
+	token, err = h.CreateToken(nil, "registry", "foo")
+	if err != nil {
+		t.Fatalf("CreateToken() failed: %v", err)
+	}
+	if kid := tokenHeader(t, token.Token)["kid"]; kid != oldID {
+		t.Errorf("kid right after rotation = %v, expected %s", kid, oldID)
+	}
+	ids := keyIDs(keys.PublicKeys())
+	if len(ids) != 2 || ids[0] != oldID || ids[1] != newID {
+		t.Errorf("PublicKeys() = %v, expected [%s %s]", ids, oldID, newID)
+	}
+
+	now = now.Add(jwksMaxAge)
+	token, err = h.CreateToken(nil, "registry", "foo")
+	if err != nil {
+		t.Fatalf("CreateToken() failed: %v", err)
+	}
+	if kid := tokenHeader(t, token.Token)["kid"]; kid != newID {
+		t.Errorf("kid after rotation = %v, expected %s", kid, newID)
+	}
+
+	ids = keyIDs(keys.PublicKeys())
+	if len(ids) != 2 || ids[0] != newID || ids[1] != oldID {
+		t.Errorf("PublicKeys() = %v, expected [%s %s]", ids, newID, oldID)
+	}
+
+	// rotating to the same key doesn't retire it
+	keys.Rotate(&newConfig.Token)
+	if ids := keyIDs(keys.PublicKeys()); len(ids) != 2 {
+		t.Errorf("PublicKeys() = %v, expected 2 keys", ids)
+	}
+
+	// the tokens of the new key have no lifetime, so it is dropped at once
+	newConfig.Token.Expiration = 0
+	keys.Rotate(&newConfig.Token)
+	keys.Rotate(&oldConfig.Token)
+	now = now.Add(jwksMaxAge)
+	ids = keyIDs(keys.PublicKeys())
+	if len(ids) != 1 || ids[0] != oldID {
+		t.Errorf("PublicKeys() = %v, expected [%s]", ids, oldID)
+	}
+}
+
+func TestKeyringPreviousCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldConfig := newTestConfig(t, filepath.Join(dir, "old"))
+	config := newTestConfig(t, dir)
+
+	config.Token.PreviousCertificates = []string{oldConfig.Token.Certificate}
+	if err := config.LoadCerts(); err != nil {
+		t.Fatalf("error loading certs: %v", err)
+	}
+
+	ids := keyIDs(NewKeyring(&config.Token).PublicKeys())
+	expected := []string{config.Token.publicKey.KeyID(), oldConfig.Token.publicKey.KeyID()}
+	if len(ids) != 2 || ids[0] != expected[0] || ids[1] != expected[1] {
+		t.Errorf("PublicKeys() = %v, expected %v", ids, expected)
+	}
+
+	config.Token.PreviousCertificates = []string{oldConfig.Token.Key}
+	if err := config.LoadCerts(); err == nil {
+		t.Errorf("expected error loading a key as previous certificate")
+	}
+}
@@ -0,0 +1,88 @@
+package godoauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/docker/libtrust"
+)
+
+// loadPrivateKey reads the token signing key from a PEM (PKCS#1, SEC 1 or
+// PKCS#8) or JSON Web Key file.
+func loadPrivateKey(keyFile string) (libtrust.PrivateKey, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '{' {
+		return parsePrivateKeyJWK(b)
+	}
+	return parsePrivateKeyPEM(b)
+}
+
+func parsePrivateKeyPEM(b []byte) (libtrust.PrivateKey, error) {
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM encoded private key found")
+		}
+
+		var key crypto.PrivateKey
+		var err error
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		default:
+			// e.g. the EC PARAMETERS written by openssl
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return fromCryptoPrivateKey(key)
+	}
+}
+
+func parsePrivateKeyJWK(b []byte) (libtrust.PrivateKey, error) {
+	jwk := make(map[string]interface{})
+	if err := json.Unmarshal(b, &jwk); err != nil {
+		return nil, fmt.Errorf("decoding JWK private key: %s", err)
+	}
+	if jwk["kty"] == "OKP" {
+		return ed25519PrivateKeyFromJWK(jwk)
+	}
+
+	// libtrust rejects a kid which is not its own key ID, the tokens are
+	// signed with the libtrust key ID anyway
+	delete(jwk, "kid")
+	b, err := json.Marshal(jwk)
+	if err != nil {
+		return nil, err
+	}
+	return libtrust.UnmarshalPrivateKeyJWK(b)
+}
+
+func fromCryptoPrivateKey(key crypto.PrivateKey) (libtrust.PrivateKey, error) {
+	if key, ok := key.(ed25519.PrivateKey); ok {
+		return newEd25519PrivateKey(key), nil
+	}
+	return libtrust.FromCryptoPrivateKey(key)
+}
+
+func fromCryptoPublicKey(key crypto.PublicKey) (libtrust.PublicKey, error) {
+	if key, ok := key.(ed25519.PublicKey); ok {
+		return newEd25519PublicKey(key), nil
+	}
+	return libtrust.FromCryptoPublicKey(key)
+}
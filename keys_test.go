@@ -0,0 +1,283 @@
+package godoauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/libtrust"
+)
+
+// writeKeyFile stores the private key in dir in the given format
+func writeKeyFile(t *testing.T, dir, name string, key crypto.Signer, format string) string {
+	var b []byte
+	var err error
+	switch format {
+	case "pkcs1":
+		b = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey))})
+	case "sec1":
+		der, err := x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	case "pkcs8":
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	case "jwk":
+		jwk := make(map[string]interface{})
+		if k, ok := key.(ed25519.PrivateKey); ok {
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["d"] = base64.RawURLEncoding.EncodeToString(k.Seed())
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(k.Public().(ed25519.PublicKey))
+		} else {
+			k, err := libtrust.FromCryptoPrivateKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ = k.MarshalJSON()
+			json.Unmarshal(b, &jwk)
+		}
+		// a key ID computed by another tool
+		jwk["kid"] = "some-other-key-id"
+		b, err = json.Marshal(jwk)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeCertFile stores a self-signed certificate of the key in dir
+func writeCertFile(t *testing.T, dir, name string, key crypto.Signer) string {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Token"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func b64(t *testing.T, s string) []byte {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("error decoding %q: %v", s, err)
+	}
+	return b
+}
+
+// verifyJWS verifies the token with the key of the JWK set matching its
+// kid, like a registry fetching the keys would, with the standard library
+// only.
+func verifyJWS(t *testing.T, token string, jwks []byte) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed token %q", token)
+	}
+	header := tokenHeader(t, token)
+	alg, _ := header["alg"].(string)
+
+	set := struct {
+		Keys []map[string]string `json:"keys"`
+	}{}
+	if err := json.Unmarshal(jwks, &set); err != nil {
+		t.Fatalf("error unmarshalling JWK set: %v", err)
+	}
+	var jwk map[string]string
+	for _, key := range set.Keys {
+		if key["kid"] == header["kid"] {
+			jwk = key
+		}
+	}
+	if jwk == nil {
+		t.Fatalf("no key with kid %v in %s", header["kid"], jwks)
+	}
+	if jwk["alg"] != alg {
+		t.Errorf("JWK alg = %q, expected %q", jwk["alg"], alg)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	sig := b64(t, parts[2])
+
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+
+	var ok bool
+	switch {
+	case alg == "EdDSA" && jwk["kty"] == "OKP":
+		ok = ed25519.Verify(ed25519.PublicKey(b64(t, jwk["x"])), signed, sig)
+
+	case strings.HasPrefix(alg, "RS") && jwk["kty"] == "RSA":
+		hash := hashes[alg[2:]]
+		h := hash.New()
+		h.Write(signed)
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(b64(t, jwk["n"])),
+			E: int(new(big.Int).SetBytes(b64(t, jwk["e"])).Int64()),
+		}
+		ok = rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig) == nil
+
+	case strings.HasPrefix(alg, "ES") && jwk["kty"] == "EC":
+		hash := hashes[alg[2:]]
+		h := hash.New()
+		h.Write(signed)
+		curve := curves[jwk["crv"]]
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(b64(t, jwk["x"])),
+			Y:     new(big.Int).SetBytes(b64(t, jwk["y"])),
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			t.Fatalf("ECDSA signature has %d bytes, expected %d", len(sig), 2*size)
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		ok = ecdsa.Verify(pub, h.Sum(nil), r, s)
+
+	default:
+		t.Fatalf("unexpected alg %s for %s key", alg, jwk["kty"])
+	}
+	if !ok {
+		t.Errorf("%s signature of the token not verified", alg)
+	}
+}
+
+func TestTokenSigningKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p521Key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name   string
+		key    crypto.Signer
+		format string
+		cert   bool
+		alg    string
+	}{
+		{"rsa-pkcs1-cert", rsaKey, "pkcs1", true, "RS256"},
+		{"rsa-pkcs8", rsaKey, "pkcs8", false, "RS256"},
+		{"rsa-jwk", rsaKey, "jwk", false, "RS256"},
+		{"p256-sec1-cert", p256Key, "sec1", true, "ES256"},
+		{"p384-pkcs8", p384Key, "pkcs8", false, "ES384"},
+		{"p521-jwk", p521Key, "jwk", false, "ES512"},
+		{"ed25519-pkcs8-cert", edKey, "pkcs8", true, "EdDSA"},
+		{"ed25519-jwk", edKey, "jwk", false, "EdDSA"},
+	}
+
+	for _, tt := range tests {
+		config := &Config{
+			HTTP: ServerConf{Timeout: 5 * time.Second},
+			Token: Token{
+				Issuer:     "Token",
+				Expiration: 800,
+				Key:        writeKeyFile(t, dir, tt.name+".key", tt.key, tt.format),
+			},
+		}
+		if tt.cert {
+			config.Token.Certificate = writeCertFile(t, dir, tt.name+".pem", tt.key)
+		}
+		if err := config.LoadCerts(); err != nil {
+			t.Errorf("%s: error loading certs: %v", tt.name, err)
+			continue
+		}
+
+		authHandler := &TokenAuthHandler{Config: config}
+		token, err := authHandler.CreateToken([]*Scope{{Type: "repository", Name: "foo/bar", Actions: PrivPull}}, "registry", "foo")
+		if err != nil {
+			t.Errorf("%s: CreateToken() failed: %v", tt.name, err)
+			continue
+		}
+		if alg := tokenHeader(t, token.Token)["alg"]; alg != tt.alg {
+			t.Errorf("%s: alg = %v, expected %s", tt.name, alg, tt.alg)
+		}
+
+		request, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+		response := httptest.NewRecorder()
+		NewHandler(authHandler).ServeHTTP(response, request)
+		verifyJWS(t, token.Token, response.Body.Bytes())
+
+		// the registry verifies RSA and EC keys with libtrust
+		if tt.alg == "EdDSA" {
+			continue
+		}
+		keys, err := libtrust.UnmarshalPublicKeyJWKSet(response.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%s: error unmarshalling JWK set: %v", tt.name, err)
+		}
+		parts := strings.Split(token.Token, ".")
+		if err := keys[0].Verify(strings.NewReader(parts[0]+"."+parts[1]), tt.alg, b64(t, parts[2])); err != nil {
+			t.Errorf("%s: libtrust verification failed: %v", tt.name, err)
+		}
+	}
+}
+
+func TestLoadCertsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	garbage := filepath.Join(dir, "garbage.key")
+	ioutil.WriteFile(garbage, []byte("not a key"), 0600)
+
+	tests := []struct {
+		name      string
+		key, cert string
+	}{
+		{"mismatching certificate", writeKeyFile(t, dir, "p256.key", p256Key, "sec1"), writeCertFile(t, dir, "ed25519.pem", edKey)},
+		{"garbage key", garbage, ""},
+		{"missing key", filepath.Join(dir, "missing.key"), ""},
+	}
+	for _, tt := range tests {
+		config := &Config{Token: Token{Key: tt.key, Certificate: tt.cert}}
+		if err := config.LoadCerts(); err == nil {
+			t.Errorf("%s: expected error loading certs", tt.name)
+		}
+	}
+}
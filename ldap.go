@@ -0,0 +1,283 @@
+package godoauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/net/context"
+)
+
+// LDAPBackend is the UserBackend authenticating the users against a LDAP or
+// Active Directory server. Users bind with their own credentials, either
+// directly with the DN built from the user_dn template or after their DN was
+// searched with the bind_dn account. The access of the user is the union of
+// the access mapped to each of the LDAP groups the user is member of.
+type LDAPBackend struct {
+	Config *LDAP
+
+	tlsConfig   *tls.Config
+	groupAccess map[string]map[string]Priv
+}
+
+// NewLDAPBackend returns a new LDAPBackend for the LDAP config.
+func NewLDAPBackend(c *LDAP) (*LDAPBackend, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CACert != "" {
+		pem, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CACert)
+		}
+	}
+
+	groupAccess := make(map[string]map[string]Priv)
+	for group, access := range c.Groups {
+		groupAccess[group], err = parseAccess(access)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access for LDAP group %s", group)
+		}
+	}
+
+	return &LDAPBackend{
+		Config:      c,
+		tlsConfig:   tlsConfig,
+		groupAccess: groupAccess,
+	}, nil
+}
+
+// dial opens a new connection to the LDAP server and upgrades it
+// to TLS if StartTLS is enabled
+func (b *LDAPBackend) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(b.Config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: b.Config.Timeout}),
+		ldap.DialWithTLSConfig(b.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(b.Config.Timeout)
+
+	if b.Config.StartTLS {
+		if err := conn.StartTLS(b.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// userDN returns the DN of the user, the DN is empty if the user was not found
+func (b *LDAPBackend) userDN(conn *ldap.Conn, username string) (string, error) {
+	if b.Config.UserDN != "" {
+		return fmt.Sprintf(b.Config.UserDN, escapeDN(username)), nil
+	}
+
+	if b.Config.BindDN != "" {
+		if err := conn.Bind(b.Config.BindDN, b.Config.BindPassword); err != nil {
+			return "", err
+		}
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		b.Config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(b.Config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn"}, nil))
+	if err != nil {
+		return "", err
+	}
+	if len(res.Entries) != 1 {
+		return "", nil
+	}
+	return res.Entries[0].DN, nil
+}
+
+// groups returns the names of the groups the user is member of
+func (b *LDAPBackend) groups(conn *ldap.Conn, dn string) ([]string, error) {
+	if b.Config.BindDN != "" {
+		if err := conn.Bind(b.Config.BindDN, b.Config.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	baseDN := b.Config.GroupBaseDN
+	if baseDN == "" {
+		baseDN = b.Config.BaseDN
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(b.Config.GroupFilter, ldap.EscapeFilter(dn)),
+		[]string{b.Config.GroupAttribute}, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, entry := range res.Entries {
+		groups = append(groups, entry.GetAttributeValues(b.Config.GroupAttribute)...)
+	}
+	return groups, nil
+}
+
+// RetrieveUser returns the user without contacting the LDAP server, the lookup
+// happens together with the bind in Authenticate
+func (b *LDAPBackend) RetrieveUser(ctx context.Context, service, account string) (*UserInfo, error) {
+	return &UserInfo{
+		Username: account,
+		Access:   make(map[string]Priv),
+	}, nil
+}
+
+// Authenticate binds to the LDAP server as the user and resolves the access
+// of the user from its group membership
+func (b *LDAPBackend) Authenticate(ctx context.Context, user *UserInfo, password string) (bool, error) {
+	// an empty password is an unauthenticated bind which most servers accept
+	if password == "" {
+		return false, nil
+	}
+
+	conn, err := b.dial()
+	if err != nil {
+		ctxLogger(ctx).Errorf("error while connecting to ldap server: %v", err)
+		return false, ErrInternal
+	}
+	defer conn.Close()
+
+	dn, err := b.userDN(conn, user.Username)
+	if err != nil {
+		ctxLogger(ctx).Warnf("error while searching ldap user %s: %v", user.Username, err)
+		return false, ErrInternal
+	}
+	if dn == "" {
+		return false, nil
+	}
+
+	if err := conn.Bind(dn, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return false, nil
+		}
+		ctxLogger(ctx).Debugf("error while binding ldap user %s: %v", dn, err)
+		return false, ErrInternal
+	}
+
+	if err := b.resolveAccess(ctx, conn, dn, user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RefreshUser looks the user up with the bind_dn account, without its
+// password, and resolves its access from its current groups. Users not
+// found, or excluded by the user_filter, are reported with ErrForbidden.
+// Without bind_dn the users cannot be looked up and ErrUnauthorized is
+// returned.
+func (b *LDAPBackend) RefreshUser(ctx context.Context, service, account string) (*UserInfo, error) {
+	if b.Config.BindDN == "" {
+		return nil, ErrUnauthorized
+	}
+
+	conn, err := b.dial()
+	if err != nil {
+		ctxLogger(ctx).Errorf("error while connecting to ldap server: %v", err)
+		return nil, ErrInternal
+	}
+	defer conn.Close()
+
+	dn, err := b.userDN(conn, account)
+	if err == nil && dn != "" && b.Config.UserDN != "" {
+		// the DN built from the template has to be checked
+		dn, err = b.checkDN(conn, dn)
+	}
+	if err != nil {
+		ctxLogger(ctx).Warnf("error while searching ldap user %s: %v", account, err)
+		return nil, ErrInternal
+	}
+	if dn == "" {
+		return nil, ErrForbidden
+	}
+
+	user, _ := b.RetrieveUser(ctx, service, account)
+	if err := b.resolveAccess(ctx, conn, dn, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// checkDN returns the DN if the entry exists, an empty DN otherwise
+func (b *LDAPBackend) checkDN(conn *ldap.Conn, dn string) (string, error) {
+	if err := conn.Bind(b.Config.BindDN, b.Config.BindPassword); err != nil {
+		return "", err
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)", []string{"dn"}, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(res.Entries) != 1 {
+		return "", nil
+	}
+	return dn, nil
+}
+
+// resolveAccess sets the groups of the user and the access mapped to them
+func (b *LDAPBackend) resolveAccess(ctx context.Context, conn *ldap.Conn, dn string, user *UserInfo) error {
+	groups, err := b.groups(conn, dn)
+	if err != nil {
+		ctxLogger(ctx).Errorf("error while searching ldap groups of %s: %v", dn, err)
+		return ErrInternal
+	}
+
+	for _, group := range groups {
+		for name, p := range b.groupAccess[group] {
+			user.Access[name] |= p
+		}
+	}
+	user.Groups = groups
+	return nil
+}
+
+// Access returns the access resolved from the groups in Authenticate
+func (b *LDAPBackend) Access(ctx context.Context, user *UserInfo) (map[string]Priv, error) {
+	return user.Access, nil
+}
+
+// escapeDN escapes the special characters of a DN attribute value (RFC 4514)
+func escapeDN(s string) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ',' || c == '+' || c == '"' || c == '\\' || c == '<' || c == '>' || c == ';' || c == '=':
+			buf = append(buf, '\\', c)
+		case c == 0:
+			buf = append(buf, "\\00"...)
+		case (c == ' ' || c == '#') && i == 0, c == ' ' && i == len(s)-1:
+			buf = append(buf, '\\', c)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return string(buf)
+}
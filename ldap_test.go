@@ -0,0 +1,417 @@
+package godoauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/net/context"
+)
+
+// testLDAPServer is a minimal in-process LDAP server supporting simple binds,
+// searches with and/or/equality/present filters and StartTLS
+type testLDAPServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	entries   map[string]map[string][]string
+	passwords map[string]string
+}
+
+func newTestLDAPServer(t *testing.T, tlsConfig *tls.Config, ldaps bool) *testLDAPServer {
+	var l net.Listener
+	var err error
+	if ldaps {
+		l, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatalf("error starting ldap server: %v", err)
+	}
+
+	s := &testLDAPServer{
+		listener:  l,
+		tlsConfig: tlsConfig,
+		entries: map[string]map[string][]string{
+			"uid=foo,ou=people,dc=example,dc=org": {"uid": {"foo"}, "objectClass": {"person"}},
+			"uid=bar,ou=people,dc=example,dc=org": {"uid": {"bar"}, "objectClass": {"person"}},
+			"cn=team-a,ou=groups,dc=example,dc=org": {
+				"cn":     {"team-a"},
+				"member": {"uid=foo,ou=people,dc=example,dc=org"},
+			},
+			"cn=team-b,ou=groups,dc=example,dc=org": {
+				"cn":     {"team-b"},
+				"member": {"uid=foo,ou=people,dc=example,dc=org", "uid=bar,ou=people,dc=example,dc=org"},
+			},
+		},
+		passwords: map[string]string{
+			"cn=admin,dc=example,dc=org":          "secret",
+			"uid=foo,ou=people,dc=example,dc=org": "bar",
+			"uid=bar,ou=people,dc=example,dc=org": "foo",
+		},
+	}
+	go s.serve()
+	return s
+}
+
+func (s *testLDAPServer) Close() {
+	s.listener.Close()
+}
+
+func (s *testLDAPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testLDAPServer) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			code := ldap.LDAPResultInvalidCredentials
+			if pw, ok := s.passwords[dn]; ok && pw == op.Children[2].Data.String() {
+				code = ldap.LDAPResultSuccess
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationBindResponse, code).Bytes())
+
+		case ldap.ApplicationSearchRequest:
+			base := op.Children[0].Value.(string)
+			var attributes []string
+			for _, a := range op.Children[7].Children {
+				attributes = append(attributes, a.Value.(string))
+			}
+			for dn, attrs := range s.entries {
+				if !strings.HasSuffix(dn, base) || !matchTestFilter(op.Children[6], attrs) {
+					continue
+				}
+				conn.Write(ldapEntry(id, dn, attrs, attributes).Bytes())
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+
+		case ldap.ApplicationExtendedRequest:
+			conn.Write(ldapResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess).Bytes())
+			conn = tls.Server(conn, s.tlsConfig)
+
+		default:
+			return
+		}
+	}
+}
+
+func ldapEnvelope(id int64, op *ber.Packet) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	envelope.AppendChild(op)
+	return envelope
+}
+
+func ldapResult(id int64, tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return ldapEnvelope(id, op)
+}
+
+func ldapEntry(id int64, dn string, attrs map[string][]string, attributes []string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+	list := ber.NewSequence("")
+	for _, name := range attributes {
+		values, ok := attrs[name]
+		if !ok {
+			continue
+		}
+		attr := ber.NewSequence("")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		attr.AppendChild(set)
+		list.AppendChild(attr)
+	}
+	op.AppendChild(list)
+	return ldapEnvelope(id, op)
+}
+
+func matchTestFilter(f *ber.Packet, attrs map[string][]string) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, c := range f.Children {
+			if !matchTestFilter(c, attrs) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, c := range f.Children {
+			if matchTestFilter(c, attrs) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterEqualityMatch:
+		for _, v := range attrs[f.Children[0].Value.(string)] {
+			if v == f.Children[1].Value.(string) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		_, ok := attrs[f.Data.String()]
+		return ok
+	default:
+		return false
+	}
+}
+
+// newTestTLSConfig returns a server TLS config with a self signed
+// certificate for 127.0.0.1, the certificate is stored in dir
+func newTestTLSConfig(t *testing.T, dir string) (*tls.Config, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}, caFile
+}
+
+func TestLDAPBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tlsConfig, caFile := newTestTLSConfig(t, dir)
+
+	plain := newTestLDAPServer(t, tlsConfig, false)
+	defer plain.Close()
+	secure := newTestLDAPServer(t, tlsConfig, true)
+	defer secure.Close()
+
+	groups := map[string]string{
+		"team-a": "repository:team-a/app:*",
+		"team-b": "repository:shared/db:pull;repository:team-a/app:pull",
+	}
+	configs := map[string]*LDAP{
+		"bind as user": {
+			URL:    "ldap://" + plain.listener.Addr().String(),
+			UserDN: "uid=%s,ou=people,dc=example,dc=org",
+			BaseDN: "dc=example,dc=org",
+			Groups: groups,
+		},
+		"search then bind with StartTLS": {
+			URL:          "ldap://" + plain.listener.Addr().String(),
+			StartTLS:     true,
+			CACert:       caFile,
+			BindDN:       "cn=admin,dc=example,dc=org",
+			BindPassword: "secret",
+			BaseDN:       "ou=people,dc=example,dc=org",
+			GroupBaseDN:  "ou=groups,dc=example,dc=org",
+			Groups:       groups,
+		},
+		"search then bind with LDAPS": {
+			URL:          "ldaps://" + secure.listener.Addr().String(),
+			CACert:       caFile,
+			BindDN:       "cn=admin,dc=example,dc=org",
+			BindPassword: "secret",
+			BaseDN:       "dc=example,dc=org",
+			UserFilter:   "(&(uid=%s)(uid=*))",
+			Groups:       groups,
+		},
+	}
+
+	tests := []struct {
+		user, pass string
+		ok         bool
+		access     map[string]Priv
+	}{
+		{"foo", "bar", true, map[string]Priv{"team-a/app": PrivPush | PrivPull, "shared/db": PrivPull}},
+		{"bar", "foo", true, map[string]Priv{"shared/db": PrivPull, "team-a/app": PrivPull}},
+		{"foo", "wrong", false, nil},
+		{"foo", "", false, nil},
+		{"unknown", "bar", false, nil},
+	}
+
+	ctx := context.Background()
+	for name, c := range configs {
+		// defaults usually set while parsing the config file
+		if c.UserFilter == "" {
+			c.UserFilter = "(uid=%s)"
+		}
+		c.GroupFilter = "(member=%s)"
+		c.GroupAttribute = "cn"
+		c.Timeout = 3 * time.Second
+
+		b, err := NewLDAPBackend(c)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+
+		for _, tt := range tests {
+			user, err := b.RetrieveUser(ctx, "registry", tt.user)
+			if err != nil {
+				t.Fatalf("%s: RetrieveUser(%q) unexpected error %v", name, tt.user, err)
+			}
+			ok, err := b.Authenticate(ctx, user, tt.pass)
+			if err != nil || ok != tt.ok {
+				t.Errorf("%s: Authenticate(%q, %q) = %v, %v, expected %v", name, tt.user, tt.pass, ok, err, tt.ok)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			access, err := b.Access(ctx, user)
+			if err != nil || !reflect.DeepEqual(access, tt.access) {
+				t.Errorf("%s: Access(%q) = %v, %v, expected %v", name, tt.user, access, err, tt.access)
+			}
+		}
+	}
+}
+
+func TestLDAPRefreshUser(t *testing.T) {
+	server := newTestLDAPServer(t, nil, false)
+	defer server.Close()
+
+	newBackend := func(c *LDAP) *LDAPBackend {
+		c.URL = "ldap://" + server.listener.Addr().String()
+		c.BaseDN = "dc=example,dc=org"
+		c.UserFilter = "(uid=%s)"
+		c.GroupFilter = "(member=%s)"
+		c.GroupAttribute = "cn"
+		c.Timeout = 3 * time.Second
+		c.Groups = map[string]string{"team-a": "repository:team-a/app:*"}
+		b, err := NewLDAPBackend(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	search := newBackend(&LDAP{BindDN: "cn=admin,dc=example,dc=org", BindPassword: "secret"})
+	template := newBackend(&LDAP{BindDN: "cn=admin,dc=example,dc=org", BindPassword: "secret", UserDN: "uid=%s,ou=people,dc=example,dc=org"})
+	noBindDN := newBackend(&LDAP{UserDN: "uid=%s,ou=people,dc=example,dc=org"})
+
+	ctx := context.Background()
+	for name, b := range map[string]*LDAPBackend{"search": search, "template": template} {
+		user, err := b.RefreshUser(ctx, "registry", "foo")
+		if err != nil {
+			t.Fatalf("%s: RefreshUser(foo) unexpected error %v", name, err)
+		}
+		if expected := map[string]Priv{"team-a/app": PrivPush | PrivPull}; !reflect.DeepEqual(user.Access, expected) {
+			t.Errorf("%s: RefreshUser(foo) access %v, expected %v", name, user.Access, expected)
+		}
+		if _, err := b.RefreshUser(ctx, "registry", "unknown"); err != ErrForbidden {
+			t.Errorf("%s: RefreshUser(unknown) = %v, expected ErrForbidden", name, err)
+		}
+	}
+	if _, err := noBindDN.RefreshUser(ctx, "registry", "foo"); err != ErrUnauthorized {
+		t.Errorf("RefreshUser() without bind_dn = %v, expected ErrUnauthorized", err)
+	}
+
+	// the refresh grant fails when the LDAP server is not reachable
+	down := newBackend(&LDAP{BindDN: "cn=admin,dc=example,dc=org", BindPassword: "secret"})
+	down.Config.URL = "ldap://127.0.0.1:1"
+	if _, err := down.RefreshUser(ctx, "registry", "foo"); err != ErrInternal {
+		t.Errorf("RefreshUser() with unreachable server = %v, expected ErrInternal", err)
+	}
+
+	// a user removed from LDAP cannot refresh its token any more
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	refreshTokens := NewRefreshTokenStore(time.Hour)
+	h := &TokenAuthHandler{
+		Config:        newTestConfig(t, dir),
+		Backend:       search,
+		RefreshTokens: refreshTokens,
+	}
+	refresh := func(account string) int {
+		token, _ := refreshTokens.Issue("registry", account, "docker")
+		return postToken(h, "/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"service":       {"registry"},
+			"client_id":     {"docker"},
+			"refresh_token": {token},
+			"scope":         {"repository:team-a/app:push"},
+		}).Code
+	}
+	if code := refresh("foo"); code != http.StatusOK {
+		t.Errorf("POST /token refresh for foo got %v, expected %v", code, http.StatusOK)
+	}
+	if code := refresh("removed"); code != http.StatusForbidden {
+		t.Errorf("POST /token refresh for removed user got %v, expected %v", code, http.StatusForbidden)
+	}
+	h.Backend = down
+	if code := refresh("foo"); code != http.StatusInternalServerError {
+		t.Errorf("POST /token refresh with unreachable server got %v, expected %v", code, http.StatusInternalServerError)
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"foo", "foo"},
+		{"foo,ou=admins", "foo\\,ou\\=admins"},
+		{" foo ", "\\ foo\\ "},
+		{"#foo", "\\#foo"},
+		{"a+b\\c", "a\\+b\\\\c"},
+	}
+	for _, tt := range tests {
+		if out := escapeDN(tt.in); out != tt.out {
+			t.Errorf("escapeDN(%q) = %q, expected %q", tt.in, out, tt.out)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package godoauth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// NewLogger returns the logger defined in the log section of the config. It
+// writes the entries at or above the level to the log file, or to stderr,
+// in the json or logfmt format.
+func NewLogger(c *Log) (*logrus.Logger, error) {
+	logger := logrus.New()
+
+	level := c.Level
+	if level == "" {
+		level = "info"
+	}
+	var err error
+	if logger.Level, err = logrus.ParseLevel(level); err != nil {
+		return nil, err
+	}
+
+	switch c.Format {
+	case "json":
+		logger.Formatter = &logrus.JSONFormatter{}
+	case "", "logfmt":
+		logger.Formatter = &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+	default:
+		return nil, fmt.Errorf("unsupported log format %s", c.Format)
+	}
+
+	if c.File != "" {
+		f, err := os.OpenFile(c.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		logger.Out = f
+	}
+	return logger, nil
+}
+
+type logKeyType int
+
+var logKey = logKeyType(0)
+
+// requestLog holds the fields logged with every entry of a request, the
+// fields learnt while handling the request are added to it
+type requestLog struct {
+	logger *logrus.Logger
+
+	mu     sync.Mutex
+	fields logrus.Fields
+}
+
+// withRequestLog returns a context logging to the logger with the fields
+func withRequestLog(ctx context.Context, logger *logrus.Logger, fields logrus.Fields) context.Context {
+	return context.WithValue(ctx, logKey, &requestLog{logger: logger, fields: fields})
+}
+
+// addLogFields adds the fields to the later log entries of the request
+func addLogFields(ctx context.Context, fields logrus.Fields) {
+	l, ok := ctx.Value(logKey).(*requestLog)
+	if !ok {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, v := range fields {
+		l.fields[k] = v
+	}
+}
+
+// ctxLogger returns the log entry of the request, or of the standard logger
+// outside of a request
+func ctxLogger(ctx context.Context) *logrus.Entry {
+	l, ok := ctx.Value(logKey).(*requestLog)
+	if !ok {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.logger.WithFields(l.fields)
+}
+
+// scopeList formats the scopes for the log, separated by spaces like in the
+// OAuth2 request
+func scopeList(scopes []*Scope) string {
+	return strings.Join(scopeStrings(scopes), " ")
+}
+
+func scopeStrings(scopes []*Scope) []string {
+	s := make([]string, len(scopes))
+	for i, scope := range scopes {
+		s[i] = scope.String()
+	}
+	return s
+}
+
+// clientIP returns the address of the client without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
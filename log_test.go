@@ -0,0 +1,159 @@
+package godoauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestLogger(level logrus.Level) (*logrus.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.Out = buf
+	logger.Formatter = &logrus.JSONFormatter{}
+	logger.Level = level
+	return logger, buf
+}
+
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log entry %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRequestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, buf := newTestLogger(logrus.DebugLevel)
+	h := &TokenAuthHandler{
+		Config: newTestConfig(t, dir),
+		Backend: &fakeBackend{
+			users: map[string]*UserInfo{
+				"foo": {Username: "foo", Password: "bar", Access: map[string]Priv{"foo/baz": PrivPull}},
+			},
+		},
+		Logger: logger,
+	}
+
+	req, _ := http.NewRequest("GET", "/auth?service=registry&scope=repository:foo/baz:push,pull", nil)
+	req.RemoteAddr = "192.0.2.1:41234"
+	req.SetBasicAuth("foo", "bar")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := logEntries(t, buf)
+	if len(entries) == 0 {
+		t.Fatal("no log entry written")
+	}
+	last := entries[len(entries)-1]
+	expected := map[string]interface{}{
+		"msg":       "request completed",
+		"level":     "info",
+		"service":   "registry",
+		"account":   "foo",
+		"scope":     "repository:foo/baz:push,pull",
+		"granted":   "repository:foo/baz:pull",
+		"client_ip": "192.0.2.1",
+		"outcome":   "partial",
+		"status":    float64(http.StatusOK),
+	}
+	for k, v := range expected {
+		if last[k] != v {
+			t.Errorf("log field %s is %v, expected %v", k, last[k], v)
+		}
+	}
+	if _, ok := last["latency_ms"].(float64); !ok {
+		t.Errorf("log field latency_ms missing in %v", last)
+	}
+	id, ok := last["request_id"].(string)
+	if !ok || id == "" {
+		t.Fatalf("log field request_id missing in %v", last)
+	}
+	for _, entry := range entries {
+		if entry["request_id"] != id {
+			t.Errorf("log entry %v has not the request ID %s", entry, id)
+		}
+	}
+}
+
+func TestRequestLogLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger, buf := newTestLogger(logrus.WarnLevel)
+	h := &TokenAuthHandler{
+		Config:  newTestConfig(t, dir),
+		Backend: &fakeBackend{users: map[string]*UserInfo{"foo": {Username: "foo", Password: "bar"}}},
+		Logger:  logger,
+	}
+
+	req, _ := http.NewRequest("GET", "/auth?service=registry", nil)
+	req.SetBasicAuth("foo", "bar")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if buf.Len() != 0 {
+		t.Errorf("info entries written at the warn level: %s", buf)
+	}
+
+	logger.Level = logrus.InfoLevel
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if n := len(logEntries(t, buf)); n != 1 {
+		t.Errorf("%d entries written at the info level, expected 1: %s", n, buf)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "godoauth.log")
+
+	logger, err := NewLogger(&Log{Level: "warn", Format: "json", File: file})
+	if err != nil {
+		t.Fatalf("NewLogger() failed: %v", err)
+	}
+	logger.Info("filtered")
+	logger.Warn("written")
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "filtered") || !strings.Contains(string(b), `"msg":"written"`) {
+		t.Errorf("unexpected log file content %s", b)
+	}
+
+	if logger, err = NewLogger(&Log{}); err != nil {
+		t.Errorf("NewLogger() with the defaults failed: %v", err)
+	} else if logger.Level != logrus.InfoLevel {
+		t.Errorf("NewLogger() default level is %v, expected info", logger.Level)
+	}
+	for _, c := range []Log{{Level: "loud"}, {Format: "xml"}} {
+		if _, err := NewLogger(&c); err == nil {
+			t.Errorf("NewLogger(%+v) succeeded, expected an error", c)
+		}
+	}
+}
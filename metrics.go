@@ -0,0 +1,131 @@
+package godoauth
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "godoauth_requests_total",
+		Help: "Token requests by outcome.",
+	}, []string{"outcome"})
+
+	requestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "godoauth_request_duration_seconds",
+		Help:    "Latency of the token requests.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	vaultLookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "godoauth_vault_lookup_duration_seconds",
+		Help:    "Latency of the user and group lookups in Vault.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"type"})
+
+	// tokensIssued is labelled with the services of the metrics config
+	// only, see serviceLabel
+	tokensIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "godoauth_tokens_issued_total",
+		Help: "Tokens issued by service.",
+	}, []string{"service"})
+
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "godoauth_cache_lookups_total",
+		Help: "Lookups of the Vault user cache by result: hit, negative_hit, miss or stale.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, vaultLookupDuration, tokensIssued, cacheLookups)
+}
+
+// otherService is the service label of the services missing in the metrics
+// config
+const otherService = "other"
+
+// serviceLabel returns the service label of the issued tokens metric. The
+// service is sent by the clients, so the unlisted ones share a label instead
+// of creating a series each.
+func (m *Metrics) serviceLabel(service string) string {
+	if containsString(m.Services, service) {
+		return service
+	}
+	return otherService
+}
+
+// statusRecorder keeps the status of the response for the request metrics
+// and the audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+	// partial is set when only part of the requested scopes were granted
+	partial bool
+	// reason is the error message of a denied request
+	reason string
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code != http.StatusOK && r.reason == "" {
+		r.reason = strings.TrimSpace(string(b))
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// outcome returns the outcome label of the request: granted, partial,
+// bad_request, unauthorized, forbidden or backend_error
+func (r *statusRecorder) outcome() string {
+	switch {
+	case r.code == http.StatusOK && r.partial:
+		return "partial"
+	case r.code == http.StatusOK:
+		return "granted"
+	case r.code == http.StatusUnauthorized:
+		return "unauthorized"
+	case r.code == http.StatusForbidden:
+		return "forbidden"
+	case r.code >= http.StatusInternalServerError:
+		return "backend_error"
+	default:
+		return "bad_request"
+	}
+}
+
+// observeRequest records the outcome and latency of a token request
+func observeRequest(r *statusRecorder, start time.Time) {
+	requestsTotal.WithLabelValues(r.outcome()).Inc()
+	requestDuration.Observe(time.Since(start).Seconds())
+}
+
+// notePartialGrant flags the request when the granted scopes are fewer or
+// have less actions than the requested ones
+func notePartialGrant(w http.ResponseWriter, requested, granted []*Scope) {
+	r, ok := w.(*statusRecorder)
+	if !ok {
+		return
+	}
+	if len(granted) != len(requested) {
+		r.partial = true
+		return
+	}
+	for i := range granted {
+		if granted[i].Actions != requested[i].Actions {
+			r.partial = true
+			return
+		}
+	}
+}
+
+// observeVaultLookup records the latency of a Vault lookup of the type
+// user or group
+func observeVaultLookup(typ string, start time.Time) {
+	vaultLookupDuration.WithLabelValues(typ).Observe(time.Since(start).Seconds())
+}
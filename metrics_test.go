@@ -0,0 +1,131 @@
+package godoauth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/context"
+)
+
+// failingBackend is a UserBackend which cannot reach its storage
+type failingBackend struct {
+	fakeBackend
+}
+
+func (b *failingBackend) RetrieveUser(ctx context.Context, service, account string) (*UserInfo, error) {
+	return nil, ErrInternal
+}
+
+func TestRequestMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &TokenAuthHandler{
+		Config: newTestConfig(t, dir),
+		Backend: &fakeBackend{
+			users: map[string]*UserInfo{
+				"foo": {Username: "foo", Password: "bar", Access: map[string]Priv{"foo/bar": PrivAll, "foo/baz": PrivPull}},
+			},
+		},
+	}
+
+	tests := []struct {
+		backend    UserBackend
+		query      string
+		user, pass string
+		outcome    string
+	}{
+		{nil, "service=registry&scope=repository:foo/bar:push,pull", "foo", "bar", "granted"},
+		{nil, "service=registry&scope=repository:foo/baz:push,pull", "foo", "bar", "partial"},
+		{nil, "service=registry&scope=repository:foo/bar:pull&scope=repository:zala/srot:pull", "foo", "bar", "partial"},
+		{nil, "service=registry&scope=repository:foo/bar:pull", "foo", "wrong", "forbidden"},
+		{nil, "scope=repository:foo/bar:pull", "foo", "bar", "bad_request"},
+		{nil, "service=registry&account=foo", "", "", "unauthorized"},
+		{&failingBackend{}, "service=registry&scope=repository:foo/bar:pull", "foo", "bar", "backend_error"},
+	}
+	for _, tt := range tests {
+		handler := *h
+		if tt.backend != nil {
+			handler.Backend = tt.backend
+		}
+		before := testutil.ToFloat64(requestsTotal.WithLabelValues(tt.outcome))
+
+		req, _ := http.NewRequest("GET", "/auth?"+tt.query, nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if n := testutil.ToFloat64(requestsTotal.WithLabelValues(tt.outcome)) - before; n != 1 {
+			t.Errorf("GET /auth?%s: %s requests increased by %v, expected 1", tt.query, tt.outcome, n)
+		}
+	}
+
+	// the unlisted services are counted as other
+	h.Config.Metrics.Services = []string{"metrics-test"}
+	count := func(service string) float64 {
+		return testutil.ToFloat64(tokensIssued.WithLabelValues(service))
+	}
+	issued, other := count("metrics-test"), count("other")
+	h.CreateToken(nil, "metrics-test", "foo")
+	h.CreateToken(nil, "metrics-test", "foo")
+	h.CreateToken(nil, "unlisted", "foo")
+	if n := count("metrics-test") - issued; n != 2 {
+		t.Errorf("issued tokens of metrics-test increased by %v, expected 2", n)
+	}
+	if n := count("other") - other; n != 1 {
+		t.Errorf("issued tokens of other increased by %v, expected 1", n)
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	c, now := newTestCache(10)
+	ctx := context.Background()
+	l := &fakeLookup{users: map[string]*UserInfo{"foo": {Username: "foo"}}}
+
+	count := func(result string) float64 {
+		return testutil.ToFloat64(cacheLookups.WithLabelValues(result))
+	}
+	hits, negativeHits, misses, stale := count("hit"), count("negative_hit"), count("miss"), count("stale")
+
+	c.get(ctx, "registry", "foo", l.lookup("foo"))
+	c.get(ctx, "registry", "foo", l.lookup("foo"))
+	c.get(ctx, "registry", "bar", l.lookup("bar"))
+	c.get(ctx, "registry", "bar", l.lookup("bar"))
+	l.err = ErrInternal
+	*now = now.Add(2 * time.Minute)
+	c.get(ctx, "registry", "foo", l.lookup("foo"))
+
+	if count("hit")-hits != 1 || count("negative_hit")-negativeHits != 1 || count("miss")-misses != 2 || count("stale")-stale != 1 {
+		t.Errorf("unexpected cache lookups: hit %v, negative_hit %v, miss %v, stale %v",
+			count("hit")-hits, count("negative_hit")-negativeHits, count("miss")-misses, count("stale")-stale)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	requestsTotal.WithLabelValues("granted")
+	tokensIssued.WithLabelValues("registry")
+	requestDuration.Observe(0.1)
+
+	request, _ := http.NewRequest("GET", "/metrics", nil)
+	response := httptest.NewRecorder()
+	NewHandler(&TokenAuthHandler{}).ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("GET /metrics got %v", response.Code)
+	}
+	for _, name := range []string{"godoauth_requests_total", "godoauth_request_duration_seconds_count", "godoauth_tokens_issued_total"} {
+		if !strings.Contains(response.Body.String(), name) {
+			t.Errorf("%s missing from the metrics", name)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package godoauth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// RefreshTokenStore keeps the refresh tokens issued by the OAuth2 token
+// endpoint. The tokens are kept in memory only, so a restart of the service
+// revokes all of them and the clients have to log in again.
+type RefreshTokenStore struct {
+	lifetime time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]refreshToken
+}
+
+// refreshToken is the account a refresh token has been issued for
+type refreshToken struct {
+	service  string
+	account  string
+	clientID string
+	expires  time.Time
+}
+
+// NewRefreshTokenStore returns a new RefreshTokenStore issuing tokens valid
+// for lifetime.
+func NewRefreshTokenStore(lifetime time.Duration) *RefreshTokenStore {
+	return &RefreshTokenStore{
+		lifetime: lifetime,
+		tokens:   make(map[string]refreshToken),
+	}
+}
+
+// Issue returns a new refresh token for the account of the service, the
+// token can only be used by the client it has been issued to.
+func (s *RefreshTokenStore) Issue(service, account, clientID string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t, rt := range s.tokens {
+		if !now.Before(rt.expires) {
+			delete(s.tokens, t)
+		}
+	}
+	s.tokens[token] = refreshToken{
+		service:  service,
+		account:  account,
+		clientID: clientID,
+		expires:  now.Add(s.lifetime),
+	}
+	return token, nil
+}
+
+// Lookup returns the account of a refresh token, ok is false if the token is
+// unknown, expired or has been issued for another service or client.
+func (s *RefreshTokenStore) Lookup(token, service, clientID string) (account string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rt, ok := s.tokens[token]
+	if !ok || !time.Now().Before(rt.expires) {
+		return "", false
+	}
+	if rt.service != service || rt.clientID != clientID {
+		return "", false
+	}
+	return rt.account, true
+}
+
+// Revoke removes the refresh token if it has been issued to the client and
+// reports whether the token has been found.
+func (s *RefreshTokenStore) Revoke(token, clientID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rt, ok := s.tokens[token]
+	if !ok || rt.clientID != clientID {
+		return false
+	}
+	delete(s.tokens, token)
+	return true
+}
+
+// RevokeAccount removes all the refresh tokens of the account for the
+// service and returns how many have been removed.
+func (s *RefreshTokenStore) RevokeAccount(service, account string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for t, rt := range s.tokens {
+		if rt.service == service && rt.account == account {
+			delete(s.tokens, t)
+			n++
+		}
+	}
+	return n
+}
+
+// OAuthRequest holds the parsed OAuth2 token request
+type OAuthRequest struct {
+	GrantType    string
+	Service      string
+	ClientID     string
+	AccessType   string
+	Username     string
+	Password     string
+	RefreshToken string
+	Scopes       []*Scope
+}
+
+// parseOAuthRequest parses the form of the OAuth2 token request, only the
+// password and refresh_token grant types are supported.
+func parseOAuthRequest(req *http.Request) (*OAuthRequest, error) {
+	service, err := getService(req)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes, err := getScopes(req)
+	if err != nil {
+		return nil, err
+	}
+
+	oauthRequest := &OAuthRequest{
+		GrantType:    req.PostFormValue("grant_type"),
+		Service:      service,
+		ClientID:     req.PostFormValue("client_id"),
+		AccessType:   req.PostFormValue("access_type"),
+		Username:     req.PostFormValue("username"),
+		Password:     req.PostFormValue("password"),
+		RefreshToken: req.PostFormValue("refresh_token"),
+		Scopes:       scopes,
+	}
+
+	if oauthRequest.ClientID == "" {
+		return nil, HTTPBadRequest("missing client_id from the request.")
+	}
+
+	switch oauthRequest.GrantType {
+	case "password":
+		if oauthRequest.Username == "" || oauthRequest.Password == "" {
+			return nil, HTTPBadRequest("missing username or password from the request.")
+		}
+	case "refresh_token":
+		if oauthRequest.RefreshToken == "" {
+			return nil, HTTPBadRequest("missing refresh_token from the request.")
+		}
+	default:
+		return nil, HTTPBadRequest("unsupported grant_type.")
+	}
+	return oauthRequest, nil
+}
+
+// serveOAuth handles the OAuth2 token request. A refresh token is returned
+// for the password grant when the client asks for offline access.
+func (h *TokenAuthHandler) serveOAuth(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	oauthRequest, err := parseOAuthRequest(r)
+	if err != nil {
+		ctxLogger(ctx).Info(err.Error())
+		http.Error(w, err.Error(), err.(*HTTPAuthError).Code)
+		return
+	}
+	addLogFields(ctx, logrus.Fields{
+		"service": oauthRequest.Service,
+		"account": oauthRequest.Username,
+		"scope":   scopeList(oauthRequest.Scopes),
+	})
+	audit := auditEvent(ctx)
+	audit.Service = oauthRequest.Service
+	audit.Account = oauthRequest.Username
+	audit.Requested = scopeStrings(oauthRequest.Scopes)
+
+	var userdata *UserInfo
+	switch oauthRequest.GrantType {
+	case "password":
+		userdata, err = h.authAccount(ctx, &AuthRequest{
+			Service:  oauthRequest.Service,
+			Account:  oauthRequest.Username,
+			Password: oauthRequest.Password,
+		})
+	case "refresh_token":
+		userdata, err = h.refreshAccount(ctx, oauthRequest)
+	}
+	if err != nil {
+		ctxLogger(ctx).Infof("Auth failed %s", err)
+		http.Error(w, err.Error(), err.(*HTTPAuthError).Code)
+		return
+	}
+	if userdata == nil {
+		http.Error(w, "User has no access", http.StatusForbidden)
+		return
+	}
+
+	var refreshToken string
+	if oauthRequest.GrantType == "password" && oauthRequest.AccessType == "offline" && h.RefreshTokens != nil {
+		refreshToken, err = h.RefreshTokens.Issue(oauthRequest.Service, userdata.Username, oauthRequest.ClientID)
+		if err != nil {
+			ctxLogger(ctx).Errorf("refresh token error %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	grantedActions := h.grantScopes(oauthRequest.Scopes, userdata)
+	notePartialGrant(w, oauthRequest.Scopes, grantedActions)
+	addLogFields(ctx, logrus.Fields{"account": userdata.Username, "granted": scopeList(grantedActions)})
+	audit.Account = userdata.Username
+	audit.Granted = scopeStrings(grantedActions)
+
+	token, err := h.CreateToken(grantedActions, oauthRequest.Service, userdata.Username)
+	if err != nil {
+		ctxLogger(ctx).Errorf("token error %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.JTI = token.ID
+
+	tokenOutput := newTokenResponse(token)
+	tokenOutput.RefreshToken = refreshToken
+	writeTokenResponse(ctx, w, tokenOutput)
+}
+
+// refreshAccount returns the user of the refresh token with its current
+// access. The tokens of users removed from the backend are revoked.
+func (h *TokenAuthHandler) refreshAccount(ctx context.Context, oauthRequest *OAuthRequest) (*UserInfo, error) {
+	if h.RefreshTokens == nil {
+		return nil, ErrUnauthorized
+	}
+
+	account, ok := h.RefreshTokens.Lookup(oauthRequest.RefreshToken, oauthRequest.Service, oauthRequest.ClientID)
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+
+	var user *UserInfo
+	var err error
+	if b, ok := h.Backend.(RefreshBackend); ok {
+		user, err = b.RefreshUser(ctx, oauthRequest.Service, account)
+	} else {
+		user, err = h.Backend.RetrieveUser(ctx, oauthRequest.Service, account)
+	}
+	if err == ErrForbidden {
+		h.RefreshTokens.RevokeAccount(oauthRequest.Service, account)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.userAccess(ctx, oauthRequest.Service, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ServeRevoke handles the OAuth2 token revocation request (RFC 7009), the
+// response doesn't tell whether the token was valid.
+func (h *TokenAuthHandler) ServeRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, clientID := r.PostFormValue("token"), r.PostFormValue("client_id")
+	if token == "" || clientID == "" {
+		err := HTTPBadRequest("missing token or client_id from the request.")
+		http.Error(w, err.Error(), err.Code)
+		return
+	}
+
+	if h.RefreshTokens != nil {
+		h.RefreshTokens.Revoke(token, clientID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
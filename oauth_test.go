@@ -0,0 +1,195 @@
+package godoauth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenStore(t *testing.T) {
+	s := NewRefreshTokenStore(time.Hour)
+
+	token, err := s.Issue("registry", "foo", "docker")
+	if err != nil {
+		t.Fatalf("Issue() failed: %v", err)
+	}
+
+	if account, ok := s.Lookup(token, "registry", "docker"); !ok || account != "foo" {
+		t.Errorf("Lookup() = %q, %v, expected foo, true", account, ok)
+	}
+	if _, ok := s.Lookup(token, "other", "docker"); ok {
+		t.Errorf("Lookup() succeeded for another service")
+	}
+	if _, ok := s.Lookup(token, "registry", "other"); ok {
+		t.Errorf("Lookup() succeeded for another client")
+	}
+
+	if s.Revoke(token, "other") {
+		t.Errorf("Revoke() succeeded for another client")
+	}
+	if !s.Revoke(token, "docker") {
+		t.Errorf("Revoke() failed")
+	}
+	if _, ok := s.Lookup(token, "registry", "docker"); ok {
+		t.Errorf("Lookup() succeeded for a revoked token")
+	}
+
+	s.Issue("registry", "foo", "docker")
+	s.Issue("registry", "foo", "other")
+	s.Issue("registry", "bar", "docker")
+	if n := s.RevokeAccount("registry", "foo"); n != 2 {
+		t.Errorf("RevokeAccount() = %d, expected 2", n)
+	}
+
+	s = NewRefreshTokenStore(-time.Second)
+	token, _ = s.Issue("registry", "foo", "docker")
+	if _, ok := s.Lookup(token, "registry", "docker"); ok {
+		t.Errorf("Lookup() succeeded for an expired token")
+	}
+}
+
+func postToken(h http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, req)
+	return response
+}
+
+func TestTokenAuthHandlerOAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := &fakeBackend{
+		users: map[string]*UserInfo{
+			"foo": {Username: "foo", Password: "bar", Access: map[string]Priv{"foo/bar": PrivAll}},
+		},
+	}
+	h := NewHandler(&TokenAuthHandler{
+		Config:        newTestConfig(t, dir),
+		Backend:       backend,
+		RefreshTokens: NewRefreshTokenStore(time.Hour),
+	})
+
+	invalid := []struct {
+		form url.Values
+		code int
+	}{
+		{url.Values{"grant_type": {"password"}, "service": {"registry"}, "username": {"foo"}, "password": {"bar"}}, http.StatusBadRequest},
+		{url.Values{"grant_type": {"authorization_code"}, "service": {"registry"}, "client_id": {"docker"}}, http.StatusBadRequest},
+		{url.Values{"grant_type": {"password"}, "service": {"registry"}, "client_id": {"docker"}, "username": {"foo"}}, http.StatusBadRequest},
+		{url.Values{"grant_type": {"password"}, "service": {"registry"}, "client_id": {"docker"}, "username": {"foo"}, "password": {"wrong"}}, http.StatusForbidden},
+		{url.Values{"grant_type": {"refresh_token"}, "service": {"registry"}, "client_id": {"docker"}, "refresh_token": {"unknown"}}, http.StatusUnauthorized},
+	}
+	for _, tt := range invalid {
+		if response := postToken(h, "/token", tt.form); response.Code != tt.code {
+			t.Errorf("POST /token %v got %v, expected %v", tt.form, response.Code, tt.code)
+		}
+	}
+
+	respData := tokenResponse{}
+	response := postToken(h, "/token", url.Values{
+		"grant_type":  {"password"},
+		"service":     {"registry"},
+		"client_id":   {"docker"},
+		"access_type": {"offline"},
+		"username":    {"foo"},
+		"password":    {"bar"},
+		"scope":       {"repository:foo/bar:push repository:foo/baz:pull"},
+	})
+	if response.Code != http.StatusOK {
+		t.Fatalf("POST /token got %v, expected %v", response.Code, http.StatusOK)
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &respData); err != nil {
+		t.Fatalf("error unmarshalling JSON response: %v", err)
+	}
+	if respData.AccessToken == "" || respData.RefreshToken == "" {
+		t.Fatalf("Expected access and refresh token, but received %v", respData)
+	}
+	if respData.ExpiresIn != 800 {
+		t.Errorf("expires_in = %d, expected 800", respData.ExpiresIn)
+	}
+	if _, err := time.Parse(time.RFC3339, respData.IssuedAt); err != nil {
+		t.Errorf("invalid issued_at %q: %v", respData.IssuedAt, err)
+	}
+	access, _ := json.Marshal(tokenClaims(t, respData.AccessToken)["access"])
+	if expected := `[{"actions":["push"],"name":"foo/bar","type":"repository"}]`; string(access) != expected {
+		t.Errorf("access claim = %s, expected %s", access, expected)
+	}
+
+	refreshToken := respData.RefreshToken
+	refresh := url.Values{
+		"grant_type":    {"refresh_token"},
+		"service":       {"registry"},
+		"client_id":     {"docker"},
+		"refresh_token": {refreshToken},
+		"scope":         {"repository:foo/bar:pull"},
+	}
+	respData = tokenResponse{}
+	response = postToken(h, "/auth", refresh)
+	if response.Code != http.StatusOK {
+		t.Fatalf("POST /auth refresh got %v, expected %v", response.Code, http.StatusOK)
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &respData); err != nil {
+		t.Fatalf("error unmarshalling JSON response: %v", err)
+	}
+	if respData.RefreshToken != "" {
+		t.Errorf("Expected no new refresh token, but received %q", respData.RefreshToken)
+	}
+	if sub := tokenClaims(t, respData.AccessToken)["sub"]; sub != "foo" {
+		t.Errorf("sub claim = %v, expected foo", sub)
+	}
+
+	response = postToken(h, "/token/revoke", url.Values{"token": {refreshToken}, "client_id": {"docker"}})
+	if response.Code != http.StatusOK {
+		t.Fatalf("POST /token/revoke got %v, expected %v", response.Code, http.StatusOK)
+	}
+	if response = postToken(h, "/token", refresh); response.Code != http.StatusUnauthorized {
+		t.Errorf("POST /token with revoked token got %v, expected %v", response.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestTokenAuthHandlerOAuthRemovedUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := &fakeBackend{
+		users: map[string]*UserInfo{
+			"foo": {Username: "foo", Password: "bar"},
+		},
+	}
+	refreshTokens := NewRefreshTokenStore(time.Hour)
+	h := &TokenAuthHandler{
+		Config:        newTestConfig(t, dir),
+		Backend:       backend,
+		RefreshTokens: refreshTokens,
+	}
+
+	token, _ := refreshTokens.Issue("registry", "foo", "docker")
+	delete(backend.users, "foo")
+
+	refresh := url.Values{
+		"grant_type":    {"refresh_token"},
+		"service":       {"registry"},
+		"client_id":     {"docker"},
+		"refresh_token": {token},
+	}
+	if response := postToken(h, "/token", refresh); response.Code != http.StatusForbidden {
+		t.Errorf("POST /token for removed user got %v, expected %v", response.Code, http.StatusForbidden)
+	}
+	if _, ok := refreshTokens.Lookup(token, "registry", "docker"); ok {
+		t.Errorf("refresh token of removed user has not been revoked")
+	}
+}
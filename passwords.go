@@ -0,0 +1,186 @@
+package godoauth
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// errPlaintextPassword is returned for a password stored without hash when
+// plaintext passwords are not accepted
+var errPlaintextPassword = errors.New("password stored in plaintext")
+
+// checkPassword reports if the password matches the stored hash. The hash
+// algorithm is detected from its modular crypt prefix:
+//
+//	bcrypt:   $2a$, $2b$ or $2y$
+//	scrypt:   $scrypt$ln=<log2(N)>,r=<r>,p=<p>$<salt>$<hash>
+//	argon2id: $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+//	PBKDF2:   $pbkdf2-<sha1|sha256|sha512>$<iterations>$<salt>$<hash>
+//	SHA1:     {SHA}<hash> (htpasswd -s)
+//
+// Salts and hashes are base64 encoded without padding, '.' may be used instead
+// of '+'. Values without a known prefix are only compared as plaintext when
+// allowPlain is set. All comparisons are constant time.
+func checkPassword(hashed, password string, allowPlain bool) (bool, error) {
+	switch {
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"), strings.HasPrefix(hashed, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+
+	case strings.HasPrefix(hashed, "$scrypt$"):
+		return checkScrypt(hashed, password)
+
+	case strings.HasPrefix(hashed, "$argon2id$"):
+		return checkArgon2id(hashed, password)
+
+	case strings.HasPrefix(hashed, "$pbkdf2-"):
+		return checkPBKDF2(hashed, password)
+
+	case strings.HasPrefix(hashed, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected, err := base64.StdEncoding.DecodeString(hashed[5:])
+		if err != nil {
+			return false, fmt.Errorf("malformed SHA hash")
+		}
+		return subtle.ConstantTimeCompare(sum[:], expected) == 1, nil
+
+	case allowPlain:
+		// compare the digests so the length of the password does not leak
+		a := sha256.Sum256([]byte(password))
+		b := sha256.Sum256([]byte(hashed))
+		return subtle.ConstantTimeCompare(a[:], b[:]) == 1, nil
+
+	case strings.HasPrefix(hashed, "$"), strings.HasPrefix(hashed, "{"):
+		return false, fmt.Errorf("unsupported password hash")
+
+	default:
+		return false, errPlaintextPassword
+	}
+}
+
+// splitHash splits the modular crypt string and decodes the salt and hash,
+// which are always the last two fields
+func splitHash(hashed string, fields int) ([]string, []byte, []byte, error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != fields+1 || parts[0] != "" {
+		return nil, nil, nil, fmt.Errorf("malformed password hash")
+	}
+	salt, err := decodeHashBase64(parts[fields-1])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("malformed password hash salt")
+	}
+	key, err := decodeHashBase64(parts[fields])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, fmt.Errorf("malformed password hash")
+	}
+	return parts[1 : fields-1], salt, key, nil
+}
+
+// decodeHashBase64 decodes both the PHC (standard, unpadded) and the
+// passlib (adapted, '.' instead of '+') base64 variants
+func decodeHashBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.Replace(s, ".", "+", -1), "=")
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// parseHashParams parses the comma separated key=value hash parameters
+func parseHashParams(s string, keys ...string) (map[string]int, error) {
+	params := make(map[string]int)
+	for _, kv := range strings.Split(s, ",") {
+		x := strings.SplitN(kv, "=", 2)
+		if len(x) != 2 {
+			return nil, fmt.Errorf("malformed password hash parameters")
+		}
+		v, err := strconv.Atoi(x[1])
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("malformed password hash parameter %s", x[0])
+		}
+		params[x[0]] = v
+	}
+	for _, k := range keys {
+		if _, ok := params[k]; !ok {
+			return nil, fmt.Errorf("missing password hash parameter %s", k)
+		}
+	}
+	return params, nil
+}
+
+func checkScrypt(hashed, password string) (bool, error) {
+	fields, salt, key, err := splitHash(hashed, 4)
+	if err != nil {
+		return false, err
+	}
+	params, err := parseHashParams(fields[1], "ln", "r", "p")
+	if err != nil {
+		return false, err
+	}
+	if params["ln"] >= 32 {
+		return false, fmt.Errorf("malformed password hash parameter ln")
+	}
+	dk, err := scrypt.Key([]byte(password), salt, 1<<uint(params["ln"]), params["r"], params["p"], len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(dk, key) == 1, nil
+}
+
+func checkArgon2id(hashed, password string) (bool, error) {
+	fields, salt, key, err := splitHash(hashed, 5)
+	if err != nil {
+		return false, err
+	}
+	if fields[1] != "v=19" {
+		return false, fmt.Errorf("unsupported argon2id version %s", fields[1])
+	}
+	params, err := parseHashParams(fields[2], "m", "t", "p")
+	if err != nil {
+		return false, err
+	}
+	if params["p"] > 255 {
+		return false, fmt.Errorf("malformed password hash parameter p")
+	}
+	dk := argon2.IDKey([]byte(password), salt, uint32(params["t"]), uint32(params["m"]), uint8(params["p"]), uint32(len(key)))
+	return subtle.ConstantTimeCompare(dk, key) == 1, nil
+}
+
+func checkPBKDF2(hashed, password string) (bool, error) {
+	fields, salt, key, err := splitHash(hashed, 4)
+	if err != nil {
+		return false, err
+	}
+
+	var h func() hash.Hash
+	switch fields[0] {
+	case "pbkdf2-sha1":
+		h = sha1.New
+	case "pbkdf2-sha256":
+		h = sha256.New
+	case "pbkdf2-sha512":
+		h = sha512.New
+	default:
+		return false, fmt.Errorf("unsupported password hash %s", fields[0])
+	}
+
+	iter, err := strconv.Atoi(strings.TrimPrefix(fields[1], "i="))
+	if err != nil || iter <= 0 {
+		return false, fmt.Errorf("malformed password hash iterations")
+	}
+	dk := pbkdf2.Key([]byte(password), salt, iter, len(key), h)
+	return subtle.ConstantTimeCompare(dk, key) == 1, nil
+}
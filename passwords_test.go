@@ -0,0 +1,95 @@
+package godoauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/net/context"
+)
+
+func TestCheckPassword(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	b64 := base64.RawStdEncoding.EncodeToString
+
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("bar"), bcrypt.MinCost)
+	scryptKey, _ := scrypt.Key([]byte("bar"), salt, 1<<4, 8, 1, 32)
+	argonKey := argon2.IDKey([]byte("bar"), salt, 1, 64, 1, 32)
+	pbkdf2Key := pbkdf2.Key([]byte("bar"), salt, 1000, 32, sha256.New)
+
+	hashes := []string{
+		string(bcryptHash),
+		"$scrypt$ln=4,r=8,p=1$" + b64(salt) + "$" + b64(scryptKey),
+		"$argon2id$v=19$m=64,t=1,p=1$" + b64(salt) + "$" + b64(argonKey),
+		"$pbkdf2-sha256$1000$" + b64(salt) + "$" + b64(pbkdf2Key),
+		"$pbkdf2-sha256$i=1000$" + b64(salt) + "$" + b64(pbkdf2Key),
+		// echo -n bar | openssl dgst -sha1 -binary | base64
+		"{SHA}Ys23Ag/5IOWqZCw9QGaVDdHwH00=",
+	}
+	for _, hash := range hashes {
+		for _, allowPlain := range []bool{false, true} {
+			if ok, err := checkPassword(hash, "bar", allowPlain); !ok || err != nil {
+				t.Errorf("checkPassword(%q, %q) = %v, %v, expected true", hash, "bar", ok, err)
+			}
+			if ok, err := checkPassword(hash, "wrong", allowPlain); ok || err != nil {
+				t.Errorf("checkPassword(%q, %q) = %v, %v, expected false", hash, "wrong", ok, err)
+			}
+		}
+	}
+
+	// plaintext only with the legacy flag
+	if ok, err := checkPassword("bar", "bar", false); ok || err == nil {
+		t.Errorf("plaintext password accepted without legacy flag")
+	}
+	if ok, err := checkPassword("bar", "bar", true); !ok || err != nil {
+		t.Errorf("plaintext password rejected with legacy flag: %v", err)
+	}
+	if ok, _ := checkPassword("bar", "barbar", true); ok {
+		t.Errorf("wrong plaintext password accepted")
+	}
+
+	malformed := []string{
+		"$scrypt$ln=4,r=8$" + b64(salt) + "$" + b64(scryptKey),
+		"$scrypt$ln=4,r=8,p=1$" + b64(salt),
+		"$argon2id$v=16$m=64,t=1,p=1$" + b64(salt) + "$" + b64(argonKey),
+		"$pbkdf2-md5$1000$" + b64(salt) + "$" + b64(pbkdf2Key),
+		"$pbkdf2-sha256$zero$" + b64(salt) + "$" + b64(pbkdf2Key),
+		"$pbkdf2-sha256$1000$!!!$" + b64(pbkdf2Key),
+	}
+	for _, hash := range malformed {
+		if ok, err := checkPassword(hash, "bar", false); ok || err == nil {
+			t.Errorf("checkPassword(%q) = %v, %v, expected error", hash, ok, err)
+		}
+	}
+}
+
+func TestVaultAuthenticate(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("bar"), bcrypt.MinCost)
+	ctx := context.Background()
+
+	v, _ := NewVaultClient(&Vault{})
+	if ok, err := v.Authenticate(ctx, &UserInfo{Password: string(hash)}, "bar"); !ok || err != nil {
+		t.Errorf("Authenticate with bcrypt hash = %v, %v, expected true", ok, err)
+	}
+
+	// the plaintext password is refused and the flag logged as a warning
+	logger, buf := newTestLogger(logrus.WarnLevel)
+	logCtx := withRequestLog(ctx, logger, logrus.Fields{})
+	if ok, err := v.Authenticate(logCtx, &UserInfo{Username: "foo", Password: "bar"}, "bar"); ok || err != nil {
+		t.Errorf("Authenticate with plaintext password = %v, %v, expected false", ok, err)
+	}
+	if !strings.Contains(buf.String(), "legacy_plaintext_passwords") {
+		t.Errorf("expected a warning about legacy_plaintext_passwords, got %q", buf)
+	}
+
+	v, _ = NewVaultClient(&Vault{PlaintextPasswords: true})
+	if ok, err := v.Authenticate(ctx, &UserInfo{Password: "bar"}, "bar"); !ok || err != nil {
+		t.Errorf("Authenticate with legacy plaintext password = %v, %v, expected true", ok, err)
+	}
+}
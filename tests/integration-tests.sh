@@ -45,8 +45,15 @@ function populate_vault {
 	
 	docker exec tests_vault_1 vault mounts -address=http://localhost:8200
 	
-	#fix vault config key
-	cat vault-creds.txt | egrep ^Initial | awk '{print $4}' | xargs -I {} sed -i 's/    auth_token:.*$/    auth_token: {}/' config.yml
+	#godoauth logs in with an approle allowed to read the registry users only
+	docker exec tests_vault_1 vault auth-enable -address=http://localhost:8200 approle
+	docker exec tests_vault_1 vault policy-write -address=http://localhost:8200 registry /tests/registry.hcl
+	docker exec tests_vault_1 vault write -address=http://localhost:8200 auth/approle/role/godoauth \
+	policies=registry token_ttl=1h token_max_ttl=24h
+	
+	docker exec tests_vault_1 vault read -address=http://localhost:8200 -field=role_id auth/approle/role/godoauth/role-id \
+	| xargs -I {} sed -i 's/      role_id:.*$/      role_id: {}/' config.yml
+	docker exec tests_vault_1 vault write -address=http://localhost:8200 -f -field=secret_id auth/approle/role/godoauth/secret-id > secret-id
 	docker restart tests_godoauth_1
 }
 
@@ -114,6 +121,7 @@ rm -rf ~/.docker/
 if [[ ${1} == "clean" ]]; then
 	rm -rf data/
 	rm -rf certs/
+	rm -f secret-id
 	docker-compose stop
 	docker-compose rm -f
 	exit 0
@@ -122,6 +130,7 @@ fi
 if [[ ${1} == "rm" ]]; then
 	rm -rf data/
 	rm -rf certs/
+	rm -f secret-id
 	docker-compose stop
 	docker-compose rm -f
 	docker rmi tests_godoauth
@@ -0,0 +1,4 @@
+# read only access of godoauth to the users and groups of the registry
+path "registry/*" {
+  policy = "read"
+}
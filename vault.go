@@ -1,56 +1,152 @@
 package godoauth
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
-	"golang.org/x/net/context/ctxhttp"
+	"golang.org/x/sync/singleflight"
 )
 
+// VaultClient is the UserBackend storing the users in a Vault
+// generic secret backend mounted under the service name.
 type VaultClient struct {
 	Config *Vault
+
+	// httpClient is shared by all requests to keep the connections to
+	// Vault alive
+	httpClient     *http.Client
+	vaultEndpoints []*vaultEndpoint
+	// probes are the running health checks of the failed servers
+	probes sync.WaitGroup
+
+	// cache is nil unless the cache is enabled in the config
+	cache *userCache
+
+	// logins collapses the concurrent logins and renewals of the auth method
+	logins singleflight.Group
+
+	mu    sync.Mutex
+	login vaultLogin
+	// renewed is the time of the last renewal attempt
+	renewed time.Time
+}
+
+// NewVaultClient returns a new VaultClient for the Vault config.
+func NewVaultClient(c *Vault) (*VaultClient, error) {
+	tlsConfig, err := c.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+	client := &VaultClient{
+		Config:         c,
+		httpClient:     newVaultHTTPClient(c, tlsConfig),
+		vaultEndpoints: newVaultEndpoints(c),
+	}
+	if c.Cache.Size > 0 {
+		client.cache = newUserCache(c.Cache)
+	}
+	return client, nil
 }
 
 var errRedirect = errors.New("redirect")
 
-// getData connect to vault backends and sends a request
-// about the user and return the http.Response with the content
+// newVaultHTTPClient returns the http.Client used to talk to Vault, keeping
+// up to Pool idle connections for IdleTimeout
 //
 // If running vault in a HA mode you may need to follow the first redirect
 // to get the data from the leader
-func (c *VaultClient) getData(ctx context.Context, namespace, user string) (*http.Response, error) {
-	ctx, _ = context.WithTimeout(ctx, c.Config.Timeout)
-	client := &http.Client{
+func newVaultHTTPClient(c *Vault, tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			if len(via) > 2 {
 				return errRedirect
 			}
 			return nil
 		},
-		Transport: &http.Transport{MaxIdleConnsPerHost: c.Config.Pool},
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   c.Timeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConnsPerHost: c.Pool,
+			IdleConnTimeout:     c.IdleTimeout,
+			TLSHandshakeTimeout: c.Timeout,
+			TLSClientConfig:     tlsConfig,
+		},
 	}
+}
+
+// closeBody reads what is left of a small response body before closing it,
+// so the connection goes back to the pool
+func closeBody(resp *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+}
 
-	url := fmt.Sprintf("%s/v1/%s/%s", c.Config.HostURL(), namespace, user)
-	req, err := http.NewRequest("GET", url, nil)
+// getData connect to vault backends and sends a request
+// about the user and return the http.Response with the content
+//
+// When the token comes from an auth method and Vault refuses it, the client
+// logs in again and retries once.
+func (c *VaultClient) getData(ctx context.Context, namespace, user string) (*http.Response, error) {
+	token, resp, err := c.get(ctx, c.secretPath(namespace, user))
+	if err == nil && resp.StatusCode == http.StatusForbidden && c.canLogin() {
+		closeBody(resp)
+		c.expireToken(token)
+		_, resp, err = c.get(ctx, c.secretPath(namespace, user))
+	}
+	return resp, err
+}
+
+// get sends the GET request with the current token and returns the token
+// together with the response
+func (c *VaultClient) get(ctx context.Context, path string) (string, *http.Response, error) {
+	token, err := c.authToken(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error creating Vault API request: %v", err)
+		return "", nil, err
+	}
+	resp, err := c.do(ctx, "GET", path, token, nil)
+	return token, resp, err
+}
+
+// kvVersion returns the version of the KV secrets engine, 1 by default
+func (c *VaultClient) kvVersion() int {
+	if c.Config != nil && c.Config.KVVersion == 2 {
+		return 2
 	}
-	req.Header.Set("X-Vault-Token", c.Config.AuthToken)
-	return ctxhttp.Do(ctx, client, req)
+	return 1
 }
 
+// secretPath returns the API path of the secret at path in the mount, KV
+// version 2 reads the secrets under data/ and may pin their version
+func (c *VaultClient) secretPath(mount, path string) string {
+	if c.kvVersion() == 1 {
+		return fmt.Sprintf("/v1/%s/%s", mount, path)
+	}
+	u := fmt.Sprintf("/v1/%s/data/%s", mount, path)
+	if c.Config.SecretVersion > 0 {
+		u += fmt.Sprintf("?version=%d", c.Config.SecretVersion)
+	}
+	return u
+}
+
+// UnmarshalText decodes the user or group secret, KV version 2 nests the
+// secret under data.data next to its metadata
 func (c *VaultClient) UnmarshalText(r io.Reader) (*UserInfo, error) {
 
 	respData := struct {
-		Data struct {
-			Access   string `json:"access"`
-			Password string `json:"password"`
-		} `json:"data"`
+		Data json.RawMessage `json:"data"`
 	}{}
 
 	dec := json.NewDecoder(r)
@@ -61,51 +157,175 @@ func (c *VaultClient) UnmarshalText(r io.Reader) (*UserInfo, error) {
 		return nil, ErrInternal
 	}
 
-	accessMap := make(map[string]Priv)
-	semiColonSplit := strings.Split(respData.Data.Access, ";")
-	for _, x := range semiColonSplit {
-		xx := strings.Split(x, ":")
-		if len(xx) != 3 {
-			return nil, NewHTTPError("Wrong access format", http.StatusInternalServerError)
+	data := respData.Data
+	if c.kvVersion() == 2 && len(data) > 0 {
+		kv2 := struct {
+			Data json.RawMessage `json:"data"`
+		}{}
+		if err := json.Unmarshal(data, &kv2); err != nil {
+			return nil, ErrInternal
+		}
+		data = kv2.Data
+	}
+
+	secret := struct {
+		Access   string `json:"access"`
+		Password string `json:"password"`
+		Groups   string `json:"groups"`
+	}{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &secret); err != nil {
+			return nil, ErrInternal
+		}
+	}
+
+	accessMap, err := parseAccess(secret.Access)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, group := range strings.Split(secret.Groups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
 		}
-		accessMap[xx[1]] = NewPriv(xx[2])
 	}
 
 	return &UserInfo{
-		Password: respData.Data.Password,
+		Password: secret.Password,
 		Access:   accessMap,
+		Groups:   groups,
 	}, nil
 }
 
 //RetrieveUser retrieve username/password/acl from Vault
 func (c *VaultClient) RetrieveUser(ctx context.Context, namespace, user string) (*UserInfo, error) {
+	if c.cache == nil {
+		return c.retrieveUser(ctx, namespace, user)
+	}
+	return c.cache.get(ctx, namespace, user, func() (*UserInfo, error) {
+		return c.retrieveUser(ctx, namespace, user)
+	})
+}
+
+// Invalidate drops the user from the cache, so its next request reads the
+// user from Vault again
+func (c *VaultClient) Invalidate(namespace, user string) {
+	if c.cache != nil {
+		c.cache.invalidate(namespace, user)
+	}
+}
+
+// Purge drops all the users and groups from the cache
+func (c *VaultClient) Purge() {
+	if c.cache != nil {
+		c.cache.purge()
+	}
+}
+
+func (c *VaultClient) retrieveUser(ctx context.Context, namespace, user string) (*UserInfo, error) {
+	defer observeVaultLookup("user", time.Now())
+
 	resp, err := c.getData(ctx, namespace, user)
 	if err != nil {
-		logWithID(ctx, "error while communicating with vault server: %v", err)
+		ctxLogger(ctx).Errorf("error while communicating with vault server: %v", err)
 		return nil, ErrInternal
 	}
 
-	defer resp.Body.Close()
+	defer closeBody(resp)
 
 	switch resp.StatusCode {
 	case http.StatusOK:
 		break
 
 	case http.StatusForbidden:
-		logWithID(ctx, "DEBUG error vault token does not have enough permissions")
+		ctxLogger(ctx).Debug("error vault token does not have enough permissions")
 		return nil, ErrInternal
 
 	case http.StatusNotFound:
 		return nil, ErrForbidden
 
 	default:
-		return nil, NewHTTPError(err.Error(), resp.StatusCode)
+		ctxLogger(ctx).Errorf("unexpected vault response status: %s", resp.Status)
+		return nil, ErrInternal
 	}
 
 	userInfo, err := c.UnmarshalText(resp.Body)
 	if err != nil {
-		logWithID(ctx, "Error while unmarhsaling vault response: %v", err)
+		ctxLogger(ctx).Errorf("Error while unmarhsaling vault response: %v", err)
+		return nil, err
 	}
 	userInfo.Username = user
-	return userInfo, err
+	return userInfo, nil
+}
+
+// Authenticate checks the password against the hash stored in Vault,
+// plaintext passwords are only accepted if legacy_plaintext_passwords is set.
+// A password which cannot be checked is refused like a wrong one.
+func (c *VaultClient) Authenticate(ctx context.Context, user *UserInfo, password string) (bool, error) {
+	ok, err := checkPassword(user.Password, password, c.Config.PlaintextPasswords)
+	if err == errPlaintextPassword {
+		ctxLogger(ctx).Warnf("password of user %s is stored in plaintext in Vault, store a hash or set legacy_plaintext_passwords", user.Username)
+		return false, nil
+	}
+	if err != nil {
+		ctxLogger(ctx).Warnf("error checking password of user %s: %v", user.Username, err)
+		return false, nil
+	}
+	return ok, nil
+}
+
+// Access returns the access list stored together with the user in Vault
+func (c *VaultClient) Access(ctx context.Context, user *UserInfo) (map[string]Priv, error) {
+	return user.Access, nil
+}
+
+// RetrieveGroup retrieve the group acl stored in Vault under groups/<group>,
+// it is cached like the users
+func (c *VaultClient) RetrieveGroup(ctx context.Context, namespace, group string) (map[string]Priv, error) {
+	if group == "." || group == ".." || strings.Contains(group, "/") {
+		ctxLogger(ctx).Warnf("invalid group name %q", group)
+		return nil, nil
+	}
+	if c.cache == nil {
+		return c.retrieveGroup(ctx, namespace, group)
+	}
+	return c.cache.getGroup(ctx, namespace, group, func() (map[string]Priv, error) {
+		return c.retrieveGroup(ctx, namespace, group)
+	})
+}
+
+func (c *VaultClient) retrieveGroup(ctx context.Context, namespace, group string) (map[string]Priv, error) {
+
+	defer observeVaultLookup("group", time.Now())
+	resp, err := c.getData(ctx, namespace, "groups/"+group)
+	if err != nil {
+		ctxLogger(ctx).Errorf("error while communicating with vault server: %v", err)
+		return nil, ErrInternal
+	}
+
+	defer closeBody(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		break
+
+	case http.StatusForbidden:
+		ctxLogger(ctx).Debug("error vault token does not have enough permissions")
+		return nil, ErrInternal
+
+	case http.StatusNotFound:
+		return nil, nil
+
+	default:
+		ctxLogger(ctx).Errorf("unexpected vault response status: %s", resp.Status)
+		return nil, ErrInternal
+	}
+
+	groupInfo, err := c.UnmarshalText(resp.Body)
+	if err != nil {
+		ctxLogger(ctx).Errorf("Error while unmarhsaling vault response: %v", err)
+		return nil, err
+	}
+	return groupInfo.Access, nil
 }
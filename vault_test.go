@@ -2,8 +2,29 @@ package godoauth
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 var vaultReturnV_1 = `
@@ -36,7 +57,7 @@ func TestUnmarshalText(t *testing.T) {
 	v := &VaultClient{}
 
 	access := make(map[string]Priv)
-	access["foo/bar"] = PrivAll
+	access["foo/bar"] = PrivPush | PrivPull
 
 	r, err := v.UnmarshalText(bytes.NewBuffer([]byte(vaultReturnV_1)))
 
@@ -57,3 +78,304 @@ func TestUnmarshalText(t *testing.T) {
 	}
 
 }
+
+var vaultUserWithGroups = `
+{
+   "data":{
+      "access":"",
+      "password":"bar",
+      "groups":"team-a, team-b"
+   }
+}
+`
+
+func TestUnmarshalTextGroups(t *testing.T) {
+	v := &VaultClient{}
+
+	r, err := v.UnmarshalText(bytes.NewBuffer([]byte(vaultUserWithGroups)))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(r.Access) != 0 {
+		t.Errorf("Expected empty access, but received %v", r.Access)
+	}
+	if !reflect.DeepEqual(r.Groups, []string{"team-a", "team-b"}) {
+		t.Errorf("Expected groups team-a and team-b, but received %v", r.Groups)
+	}
+}
+
+// newTestVault starts a fake Vault server returning the secrets by path
+func newTestVault(t testing.TB, secrets map[string]string) (*httptest.Server, *Vault) {
+	return startTestVault(t, secrets, nil)
+}
+
+// startTestVault is newTestVault counting the connections accepted by the
+// server in conns
+func startTestVault(t testing.TB, secrets map[string]string, conns *int64) (*httptest.Server, *Vault) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		path := r.URL.Path
+		if r.URL.RawQuery != "" {
+			path += "?" + r.URL.RawQuery
+		}
+		secret, ok := secrets[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(secret))
+	}))
+	if conns != nil {
+		ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt64(conns, 1)
+			}
+		}
+	}
+	ts.Start()
+
+	u, _ := url.Parse(ts.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	p, _ := strconv.Atoi(port)
+	return ts, &Vault{
+		Proto:     "http",
+		Host:      host,
+		Port:      p,
+		AuthToken: "token",
+		Timeout:   time.Second,
+		Pool:      2,
+	}
+}
+
+func TestRetrieveGroup(t *testing.T) {
+	ts, config := newTestVault(t, map[string]string{
+		"/v1/registry/groups/team-a": `{"data":{"access":"repository:team-a/*:*"}}`,
+	})
+	defer ts.Close()
+
+	v, _ := NewVaultClient(config)
+	ctx := context.Background()
+
+	access, err := v.RetrieveGroup(ctx, "registry", "team-a")
+	if err != nil || !reflect.DeepEqual(access, map[string]Priv{"team-a/*": PrivPush | PrivPull}) {
+		t.Errorf("RetrieveGroup(team-a) = %v, %v", access, err)
+	}
+
+	for _, group := range []string{"unknown", "..", "team-a/../foo"} {
+		access, err = v.RetrieveGroup(ctx, "registry", group)
+		if err != nil || access != nil {
+			t.Errorf("RetrieveGroup(%q) = %v, %v, expected no access", group, access, err)
+		}
+	}
+
+	config.AuthToken = "wrong"
+	if _, err = v.RetrieveGroup(ctx, "registry", "team-a"); err != ErrInternal {
+		t.Errorf("Expected ErrInternal for wrong token, but received %v", err)
+	}
+}
+
+var vaultReturnKV2 = `
+{
+   "data":{
+      "data":{
+         "access":"repository:foo/bar:*",
+         "password":"bar",
+         "groups":"team-a"
+      },
+      "metadata":{
+         "created_time":"2018-03-22T02:24:06.945319214Z",
+         "deletion_time":"",
+         "destroyed":false,
+         "version":%d
+      }
+   }
+}
+`
+
+func TestRetrieveUserKV2(t *testing.T) {
+	ts, config := newTestVault(t, map[string]string{
+		"/v1/registry/data/foo":           fmt.Sprintf(vaultReturnKV2, 3),
+		"/v1/registry/data/foo?version=2": strings.Replace(fmt.Sprintf(vaultReturnKV2, 2), "repository:foo/bar:*", "repository:foo/bar:pull", 1),
+		"/v1/registry/data/groups/team-a": `{"data":{"data":{"access":"repository:team-a/*:pull"},"metadata":{"version":1}}}`,
+	})
+	defer ts.Close()
+
+	config.KVVersion = 2
+	v, _ := NewVaultClient(config)
+	ctx := context.Background()
+
+	user, err := v.RetrieveUser(ctx, "registry", "foo")
+	if err != nil {
+		t.Fatalf("RetrieveUser() failed: %v", err)
+	}
+	if user.Username != "foo" || user.Password != "bar" || !reflect.DeepEqual(user.Groups, []string{"team-a"}) {
+		t.Errorf("unexpected user %+v", user)
+	}
+	if !reflect.DeepEqual(user.Access, map[string]Priv{"foo/bar": PrivPush | PrivPull}) {
+		t.Errorf("Expected full access to foo/bar, but received %v", user.Access)
+	}
+
+	access, err := v.RetrieveGroup(ctx, "registry", "team-a")
+	if err != nil || !reflect.DeepEqual(access, map[string]Priv{"team-a/*": PrivPull}) {
+		t.Errorf("RetrieveGroup(team-a) = %v, %v", access, err)
+	}
+
+	if _, err := v.RetrieveUser(ctx, "registry", "unknown"); err != ErrForbidden {
+		t.Errorf("Expected ErrForbidden for unknown user, but received %v", err)
+	}
+
+	config.SecretVersion = 2
+	user, err = v.RetrieveUser(ctx, "registry", "foo")
+	if err != nil {
+		t.Fatalf("RetrieveUser() with pinned version failed: %v", err)
+	}
+	if !reflect.DeepEqual(user.Access, map[string]Priv{"foo/bar": PrivPull}) {
+		t.Errorf("Expected pull access to foo/bar from version 2, but received %v", user.Access)
+	}
+}
+
+func TestVaultMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyFile := writeKeyFile(t, dir, "client.key", clientKey, "sec1")
+	certFile := writeCertFile(t, dir, "client.pem", clientKey)
+	clientCert, _ := ioutil.ReadFile(certFile)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(vaultReturnV_1))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	ts.TLS.ClientCAs.AppendCertsFromPEM(clientCert)
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644)
+
+	u, _ := url.Parse(ts.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	p, _ := strconv.Atoi(port)
+
+	tests := []struct {
+		name string
+		tls  VaultTLS
+		ok   bool
+	}{
+		{"mutual TLS", VaultTLS{CACert: caFile, ClientCert: certFile, ClientKey: keyFile, MinVersion: "1.2"}, true},
+		{"server name", VaultTLS{CACert: caFile, ClientCert: certFile, ClientKey: keyFile, ServerName: "example.com"}, true},
+		{"wrong server name", VaultTLS{CACert: caFile, ClientCert: certFile, ClientKey: keyFile, ServerName: "vault.internal"}, false},
+		{"no client certificate", VaultTLS{CACert: caFile}, false},
+		{"system roots", VaultTLS{ClientCert: certFile, ClientKey: keyFile}, false},
+	}
+	for _, tt := range tests {
+		v, err := NewVaultClient(&Vault{
+			Proto:     "https",
+			Host:      host,
+			Port:      p,
+			AuthToken: "token",
+			Timeout:   time.Second,
+			Pool:      2,
+			TLS:       tt.tls,
+		})
+		if err != nil {
+			t.Fatalf("%s: NewVaultClient() failed: %v", tt.name, err)
+		}
+		_, err = v.RetrieveUser(context.Background(), "registry", "foo")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: RetrieveUser() = %v", tt.name, err)
+		}
+	}
+
+	for _, c := range []VaultTLS{
+		{MinVersion: "1.4"},
+		{ClientCert: certFile},
+		{CACert: filepath.Join(dir, "missing.pem")},
+		{CACert: keyFile},
+	} {
+		if _, err := NewVaultClient(&Vault{TLS: c}); err == nil {
+			t.Errorf("expected error for TLS config %+v", c)
+		}
+	}
+}
+
+func TestVaultConnectionReuse(t *testing.T) {
+	var conns int64
+	ts, config := startTestVault(t, map[string]string{
+		"/v1/registry/foo":           vaultReturnV_1,
+		"/v1/registry/groups/team-a": `{"data":{"access":"repository:team-a/*:*"}}`,
+	}, &conns)
+	defer ts.Close()
+
+	v, err := NewVaultClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// found, unknown and refused secrets all leave the connection reusable
+	for i := 0; i < 10; i++ {
+		if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+			t.Fatalf("RetrieveUser() failed: %v", err)
+		}
+		if _, err := v.RetrieveUser(ctx, "registry", "unknown"); err != ErrForbidden {
+			t.Fatalf("Expected ErrForbidden for unknown user, but received %v", err)
+		}
+		if _, err := v.RetrieveGroup(ctx, "registry", "team-a"); err != nil {
+			t.Fatalf("RetrieveGroup() failed: %v", err)
+		}
+	}
+	if n := atomic.LoadInt64(&conns); n != 1 {
+		t.Errorf("Expected 1 connection to Vault, but %d were opened", n)
+	}
+
+	// concurrent requests open at most Pool idle connections more than needed
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v.RetrieveUser(ctx, "registry", "foo")
+		}()
+	}
+	wg.Wait()
+	before := atomic.LoadInt64(&conns)
+	for i := 0; i < 10; i++ {
+		v.RetrieveUser(ctx, "registry", "foo")
+	}
+	if n := atomic.LoadInt64(&conns); n != before {
+		t.Errorf("Expected sequential requests to reuse the pool, but %d connections were opened", n-before)
+	}
+}
+
+func BenchmarkVaultRetrieveUser(b *testing.B) {
+	var conns int64
+	ts, config := startTestVault(b, map[string]string{"/v1/registry/foo": vaultReturnV_1}, &conns)
+	defer ts.Close()
+
+	config.Pool = 10
+	v, err := NewVaultClient(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(atomic.LoadInt64(&conns)), "conns")
+}
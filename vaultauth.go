@@ -0,0 +1,207 @@
+package godoauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// vaultRenewRetry is the wait before a failed renewal of the token is tried
+// again
+const vaultRenewRetry = 30 * time.Second
+
+// vaultLogin is the token godoauth got from the auth method and its lease
+type vaultLogin struct {
+	token     string
+	renewable bool
+	issued    time.Time
+	ttl       time.Duration
+}
+
+// canLogin reports whether the token comes from an auth method, so a new one
+// can be requested when Vault refuses the current one
+func (c *VaultClient) canLogin() bool {
+	return c.Config.Auth.Method != "" && c.Config.Auth.Method != "token"
+}
+
+// authToken returns the token used to access Vault. With an auth method the
+// client logs in when it has no valid token, and renews the lease once two
+// thirds of it have elapsed. The requests to Vault happen outside of the
+// lock, concurrent logins and renewals are collapsed into one.
+func (c *VaultClient) authToken(ctx context.Context) (string, error) {
+	if !c.canLogin() {
+		return c.Config.AuthToken, nil
+	}
+
+	c.mu.Lock()
+	login := c.login
+	renew := false
+	if login.token != "" && login.ttl > 0 {
+		age := time.Since(login.issued)
+		switch {
+		case age >= login.ttl:
+			login = vaultLogin{}
+		case age >= login.ttl*2/3 && login.renewable && time.Since(c.renewed) >= vaultRenewRetry:
+			c.renewed = time.Now()
+			renew = true
+		}
+	}
+	c.mu.Unlock()
+
+	if renew {
+		// a failed renewal keeps the token until it expires
+		renewed, err, _ := c.logins.Do("renew", func() (interface{}, error) {
+			return c.renew(ctx, login)
+		})
+		if err != nil {
+			ctxLogger(ctx).Errorf("error renewing vault token: %v", err)
+		} else {
+			login = *renewed.(*vaultLogin)
+		}
+	}
+
+	if login.token == "" {
+		l, err, _ := c.logins.Do("login", func() (interface{}, error) {
+			return c.authenticate(ctx)
+		})
+		if err != nil {
+			return "", err
+		}
+		login = *l.(*vaultLogin)
+	}
+	return login.token, nil
+}
+
+// setLogin stores the token, unless it replaces a token other than the
+// previous one
+func (c *VaultClient) setLogin(previous string, login *vaultLogin) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.login.token == previous {
+		c.login = *login
+	}
+}
+
+// expireToken drops the token refused by Vault, unless another request
+// already replaced it
+func (c *VaultClient) expireToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.login.token == token {
+		c.login = vaultLogin{}
+	}
+}
+
+// authenticate gets a new token with the auth method of the config
+func (c *VaultClient) authenticate(ctx context.Context) (*vaultLogin, error) {
+	c.mu.Lock()
+	previous := c.login.token
+	c.mu.Unlock()
+
+	auth := c.Config.Auth
+
+	var body map[string]string
+	switch auth.Method {
+	case "token_file":
+		token, err := readFileString(auth.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		login := &vaultLogin{token: token}
+		c.setLogin(previous, login)
+		return login, nil
+
+	case "approle":
+		secretID := auth.SecretID
+		if auth.SecretIDFile != "" {
+			var err error
+			if secretID, err = readFileString(auth.SecretIDFile); err != nil {
+				return nil, err
+			}
+		}
+		body = map[string]string{"role_id": auth.RoleID, "secret_id": secretID}
+
+	case "kubernetes":
+		jwt, err := readFileString(auth.JWTFile)
+		if err != nil {
+			return nil, err
+		}
+		body = map[string]string{"role": auth.Role, "jwt": jwt}
+
+	default:
+		return nil, fmt.Errorf("unsupported vault auth method %s", auth.Method)
+	}
+
+	login, err := c.postAuth(ctx, "/v1/auth/"+auth.Mount+"/login", "", body)
+	if err == nil && login.token == "" {
+		err = fmt.Errorf("no client token in the vault response")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("vault %s login failed: %v", auth.Method, err)
+	}
+	c.setLogin(previous, login)
+	return login, nil
+}
+
+// renew extends the lease of the token
+func (c *VaultClient) renew(ctx context.Context, current vaultLogin) (*vaultLogin, error) {
+	login, err := c.postAuth(ctx, "/v1/auth/token/renew-self", current.token, nil)
+	if err != nil {
+		return nil, err
+	}
+	if login.token == "" {
+		login.token = current.token
+	}
+	c.setLogin(current.token, login)
+	return login, nil
+}
+
+// postAuth sends a request to a Vault auth endpoint and returns the token
+// from the auth section of the response
+func (c *VaultClient) postAuth(ctx context.Context, path, token string, body interface{}) (*vaultLogin, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "POST", path, token, b)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected vault response status: %s", resp.Status)
+	}
+
+	respData := struct {
+		Auth *struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int64  `json:"lease_duration"`
+			Renewable     bool   `json:"renewable"`
+		} `json:"auth"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+		return nil, err
+	}
+	if respData.Auth == nil {
+		return nil, fmt.Errorf("no auth in the vault response")
+	}
+	return &vaultLogin{
+		token:     respData.Auth.ClientToken,
+		renewable: respData.Auth.Renewable,
+		issued:    time.Now(),
+		ttl:       time.Duration(respData.Auth.LeaseDuration) * time.Second,
+	}, nil
+}
+
+func readFileString(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,327 @@
+package godoauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeVaultAuth is a Vault server with the approle and kubernetes auth
+// methods, the tokens it issues can be revoked
+type fakeVaultAuth struct {
+	mu       sync.Mutex
+	tokens   map[string]bool
+	logins   int
+	renewals int
+	lease    int
+	// attempts counts the renewals, failRenew makes them fail
+	attempts  int
+	failRenew bool
+}
+
+func (v *fakeVaultAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	body := make(map[string]string)
+	if r.Method == "POST" {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+
+	switch r.URL.Path {
+	case "/v1/auth/approle/login":
+		if body["role_id"] != "godoauth" || body["secret_id"] != "s3cr3t" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		v.issue(w)
+
+	case "/v1/auth/k8s/login":
+		if body["role"] != "godoauth" || body["jwt"] != "service-account-jwt" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		v.issue(w)
+
+	case "/v1/auth/token/renew-self":
+		token := r.Header.Get("X-Vault-Token")
+		v.attempts++
+		if v.failRenew {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !v.tokens[token] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		v.renewals++
+		fmt.Fprintf(w, `{"auth":{"client_token":%q,"lease_duration":%d,"renewable":true}}`, token, v.lease)
+
+	case "/v1/registry/foo":
+		if !v.tokens[r.Header.Get("X-Vault-Token")] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(vaultReturnV_1))
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (v *fakeVaultAuth) issue(w http.ResponseWriter) {
+	v.logins++
+	token := fmt.Sprintf("token-%d", v.logins)
+	v.tokens[token] = true
+	fmt.Fprintf(w, `{"auth":{"client_token":%q,"lease_duration":%d,"renewable":true}}`, token, v.lease)
+}
+
+func (v *fakeVaultAuth) revokeAll() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.tokens = make(map[string]bool)
+}
+
+func (v *fakeVaultAuth) counts() (int, int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.logins, v.renewals
+}
+
+func newTestVaultAuth(t *testing.T, auth VaultAuth) (*httptest.Server, *fakeVaultAuth, *VaultClient) {
+	fake := &fakeVaultAuth{tokens: make(map[string]bool), lease: 3600}
+	ts := httptest.NewServer(fake)
+
+	u, _ := url.Parse(ts.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	p, _ := strconv.Atoi(port)
+	if err := auth.validate(); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVaultClient(&Vault{
+		Proto:   "http",
+		Host:    host,
+		Port:    p,
+		Timeout: time.Second,
+		Pool:    2,
+		Auth:    auth,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts, fake, v
+}
+
+func TestVaultAppRoleLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretIDFile := filepath.Join(dir, "secret-id")
+	ioutil.WriteFile(secretIDFile, []byte("s3cr3t\n"), 0600)
+
+	ts, fake, v := newTestVaultAuth(t, VaultAuth{Method: "approle", RoleID: "godoauth", SecretIDFile: secretIDFile})
+	defer ts.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+			t.Fatalf("RetrieveUser() failed: %v", err)
+		}
+	}
+	if logins, _ := fake.counts(); logins != 1 {
+		t.Errorf("Expected 1 login, but received %d", logins)
+	}
+
+	// a revoked token makes the client log in again
+	fake.revokeAll()
+	if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+		t.Fatalf("RetrieveUser() after revocation failed: %v", err)
+	}
+	if logins, _ := fake.counts(); logins != 2 {
+		t.Errorf("Expected 2 logins, but received %d", logins)
+	}
+
+	ioutil.WriteFile(secretIDFile, []byte("wrong"), 0600)
+	fake.revokeAll()
+	if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != ErrInternal {
+		t.Errorf("Expected ErrInternal with a wrong secret_id, but received %v", err)
+	}
+}
+
+func TestVaultKubernetesLoginRenewal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jwtFile := filepath.Join(dir, "token")
+	ioutil.WriteFile(jwtFile, []byte("service-account-jwt"), 0600)
+
+	ts, fake, v := newTestVaultAuth(t, VaultAuth{Method: "kubernetes", Mount: "k8s", Role: "godoauth", JWTFile: jwtFile})
+	defer ts.Close()
+	ctx := context.Background()
+
+	if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+		t.Fatalf("RetrieveUser() failed: %v", err)
+	}
+
+	// two thirds of the lease have elapsed
+	v.mu.Lock()
+	v.login.issued = time.Now().Add(-50 * time.Minute)
+	v.mu.Unlock()
+	if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+		t.Fatalf("RetrieveUser() failed: %v", err)
+	}
+	if logins, renewals := fake.counts(); logins != 1 || renewals != 1 {
+		t.Errorf("Expected 1 login and 1 renewal, but received %d and %d", logins, renewals)
+	}
+
+	// the lease has expired
+	v.mu.Lock()
+	v.login.issued = time.Now().Add(-2 * time.Hour)
+	v.mu.Unlock()
+	if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+		t.Fatalf("RetrieveUser() failed: %v", err)
+	}
+	if logins, renewals := fake.counts(); logins != 2 || renewals != 1 {
+		t.Errorf("Expected 2 logins and 1 renewal, but received %d and %d", logins, renewals)
+	}
+}
+
+func TestVaultLoginConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jwtFile := filepath.Join(dir, "token")
+	ioutil.WriteFile(jwtFile, []byte("service-account-jwt"), 0600)
+
+	ts, fake, v := newTestVaultAuth(t, VaultAuth{Method: "kubernetes", Mount: "k8s", Role: "godoauth", JWTFile: jwtFile})
+	defer ts.Close()
+	ctx := context.Background()
+
+	// the concurrent lookups share one login
+	fake.mu.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+				t.Errorf("RetrieveUser() failed: %v", err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	fake.mu.Unlock()
+	wg.Wait()
+	if logins, _ := fake.counts(); logins != 1 {
+		t.Errorf("Expected 1 login, but received %d", logins)
+	}
+
+	// a failed renewal is not tried again on every lookup
+	fake.mu.Lock()
+	fake.failRenew = true
+	fake.mu.Unlock()
+	v.mu.Lock()
+	v.login.issued = time.Now().Add(-50 * time.Minute)
+	v.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+			t.Fatalf("RetrieveUser() with failed renewal failed: %v", err)
+		}
+	}
+	fake.mu.Lock()
+	attempts := fake.attempts
+	fake.mu.Unlock()
+	if attempts != 1 {
+		t.Errorf("Expected 1 renewal attempt, but received %d", attempts)
+	}
+
+	// it is tried again after vaultRenewRetry
+	fake.mu.Lock()
+	fake.failRenew = false
+	fake.mu.Unlock()
+	v.mu.Lock()
+	v.renewed = v.renewed.Add(-vaultRenewRetry)
+	v.mu.Unlock()
+	if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+		t.Fatalf("RetrieveUser() failed: %v", err)
+	}
+	if logins, renewals := fake.counts(); logins != 1 || renewals != 1 {
+		t.Errorf("Expected 1 login and 1 renewal, but received %d and %d", logins, renewals)
+	}
+}
+
+func TestVaultTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godoauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	ts, fake, v := newTestVaultAuth(t, VaultAuth{Method: "token_file", TokenFile: tokenFile})
+	defer ts.Close()
+	ctx := context.Background()
+
+	fake.tokens["first"] = true
+	ioutil.WriteFile(tokenFile, []byte("first\n"), 0600)
+	if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+		t.Fatalf("RetrieveUser() failed: %v", err)
+	}
+
+	// the token is read again from the file once Vault refuses it
+	fake.revokeAll()
+	fake.tokens["second"] = true
+	ioutil.WriteFile(tokenFile, []byte("second\n"), 0600)
+	if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+		t.Fatalf("RetrieveUser() with rotated token file failed: %v", err)
+	}
+}
+
+func TestVaultAuthValidate(t *testing.T) {
+	tests := []struct {
+		auth VaultAuth
+		ok   bool
+	}{
+		{VaultAuth{}, true},
+		{VaultAuth{Method: "token_file", TokenFile: "/run/vault-token"}, true},
+		{VaultAuth{Method: "token_file"}, false},
+		{VaultAuth{Method: "approle", RoleID: "godoauth", SecretID: "s3cr3t"}, true},
+		{VaultAuth{Method: "approle", RoleID: "godoauth"}, false},
+		{VaultAuth{Method: "kubernetes", Role: "godoauth"}, true},
+		{VaultAuth{Method: "kubernetes"}, false},
+		{VaultAuth{Method: "userpass"}, false},
+	}
+	for _, tt := range tests {
+		auth := tt.auth
+		if err := auth.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(%+v) = %v", tt.auth, err)
+		}
+	}
+
+	auth := VaultAuth{Method: "kubernetes", Role: "godoauth"}
+	auth.validate()
+	if auth.Mount != "kubernetes" || auth.JWTFile != kubernetesJWTFile {
+		t.Errorf("unexpected defaults %+v", auth)
+	}
+}
@@ -0,0 +1,213 @@
+package godoauth
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// vaultBackoff is the wait before the Vault servers are tried again when
+// none of them answered, it doubles with each retry
+const vaultBackoff = 100 * time.Millisecond
+
+// endpointState is the health of a Vault server as reported by sys/health
+type endpointState int
+
+const (
+	endpointUnknown endpointState = iota
+	endpointActive
+	endpointStandby
+	endpointDown
+)
+
+// vaultEndpoint is one of the Vault servers of the cluster
+type vaultEndpoint struct {
+	url string
+
+	mu      sync.Mutex
+	state   endpointState
+	checked time.Time
+	probing bool
+}
+
+func newVaultEndpoints(c *Vault) []*vaultEndpoint {
+	var endpoints []*vaultEndpoint
+	for _, u := range c.addresses() {
+		endpoints = append(endpoints, &vaultEndpoint{url: u})
+	}
+	return endpoints
+}
+
+func (e *vaultEndpoint) status() (endpointState, time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.state, e.checked
+}
+
+func (e *vaultEndpoint) setState(state endpointState) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.state = state
+	e.checked = time.Now()
+}
+
+// endpoints returns the Vault servers in the order they are tried: the
+// active one first, then the standbys and the servers which failed last. A
+// failed server is checked again in the background once
+// health_check_interval has elapsed.
+func (c *VaultClient) endpoints() []*vaultEndpoint {
+	rank := make(map[*vaultEndpoint]endpointState)
+	for _, e := range c.vaultEndpoints {
+		state, checked := e.status()
+		if state == endpointDown && time.Since(checked) >= c.Config.HealthCheckInterval {
+			c.probe(e)
+		}
+		if state == endpointUnknown {
+			state = endpointActive
+		}
+		rank[e] = state
+	}
+
+	endpoints := append([]*vaultEndpoint(nil), c.vaultEndpoints...)
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return rank[endpoints[i]] < rank[endpoints[j]]
+	})
+	return endpoints
+}
+
+// probe checks the health of the server in the background, outside of the
+// deadline of the request which found it failing. A server is only checked
+// once at a time.
+func (c *VaultClient) probe(e *vaultEndpoint) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.probing {
+		return
+	}
+	e.probing = true
+
+	c.probes.Add(1)
+	go func() {
+		defer c.probes.Done()
+		c.checkHealth(context.Background(), e)
+
+		e.mu.Lock()
+		e.probing = false
+		e.mu.Unlock()
+	}()
+}
+
+// checkHealth updates the state of the server from its sys/health, which
+// answers 200 on the active node, 429 or 473 on a standby and an error
+// status when the server is sealed or not initialized
+func (c *VaultClient) checkHealth(ctx context.Context, e *vaultEndpoint) endpointState {
+	ctx, cancel := context.WithTimeout(ctx, c.Config.Timeout)
+	defer cancel()
+
+	state := endpointDown
+	req, err := http.NewRequest("GET", e.url+"/v1/sys/health", nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = ctxhttp.Do(ctx, c.httpClient, req); err == nil {
+			closeBody(resp)
+			switch resp.StatusCode {
+			case http.StatusOK:
+				state = endpointActive
+			case http.StatusTooManyRequests, 473:
+				state = endpointStandby
+			default:
+				err = fmt.Errorf("health status %s", resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		ctxLogger(ctx).Warnf("vault server %s is not available: %v", e.url, err)
+	}
+	e.setState(state)
+	return state
+}
+
+// do sends the request to the Vault servers until one of them answers
+// without a server error. A server failing is marked down and the next one
+// is tried at once while sys/health is checked in the background, when all
+// of them failed they are tried again up to retries times with an
+// exponential backoff.
+func (c *VaultClient) do(ctx context.Context, method, path, token string, body []byte) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	backoff := vaultBackoff
+	for retry := 0; retry <= c.Config.Retries; retry++ {
+		if retry > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				if resp != nil {
+					closeBody(resp)
+				}
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		for _, e := range c.endpoints() {
+			if resp != nil {
+				closeBody(resp)
+			}
+
+			var req *http.Request
+			req, err = http.NewRequest(method, e.url+path, bytes.NewReader(body))
+			if err != nil {
+				return nil, fmt.Errorf("error creating Vault API request: %v", err)
+			}
+			if token != "" {
+				req.Header.Set("X-Vault-Token", token)
+			}
+
+			reqCtx, cancel := context.WithTimeout(ctx, c.Config.Timeout)
+			resp, err = ctxhttp.Do(reqCtx, c.httpClient, req)
+			if err != nil {
+				cancel()
+				resp = nil
+			} else {
+				resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			}
+			if err == nil && resp.StatusCode < http.StatusInternalServerError {
+				return resp, nil
+			}
+			if ctx.Err() != nil {
+				if resp != nil {
+					closeBody(resp)
+				}
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				ctxLogger(ctx).Warnf("error while communicating with vault server %s: %v", e.url, err)
+			} else {
+				ctxLogger(ctx).Warnf("unexpected vault server %s response status: %s", e.url, resp.Status)
+			}
+			e.setState(endpointDown)
+			c.probe(e)
+		}
+	}
+	return resp, err
+}
+
+// cancelBody releases the request timeout of a response when its body is
+// closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,220 @@
+package godoauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeVaultNode is a Vault server of a cluster, the active node returns the
+// user foo
+type fakeVaultNode struct {
+	*httptest.Server
+	health   int64
+	requests int64
+	// failures is the number of requests answered with 503 first
+	failures int64
+}
+
+func newFakeVaultNode(health int64) *fakeVaultNode {
+	n := &fakeVaultNode{health: health}
+	n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := int(atomic.LoadInt64(&n.health))
+		if r.URL.Path == "/v1/sys/health" {
+			w.WriteHeader(health)
+			return
+		}
+		if atomic.AddInt64(&n.requests, 1) <= atomic.LoadInt64(&n.failures) || health != http.StatusOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(vaultReturnV_1))
+	}))
+	return n
+}
+
+func (n *fakeVaultNode) count() int64 {
+	return atomic.LoadInt64(&n.requests)
+}
+
+func newTestVaultCluster(t *testing.T, addresses ...string) *VaultClient {
+	v, err := NewVaultClient(&Vault{
+		Addresses:           addresses,
+		AuthToken:           "token",
+		Timeout:             time.Second,
+		Pool:                2,
+		HealthCheckInterval: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestVaultFailover(t *testing.T) {
+	down := newFakeVaultNode(http.StatusOK)
+	down.Close()
+	sealed := newFakeVaultNode(http.StatusServiceUnavailable)
+	defer sealed.Close()
+	active := newFakeVaultNode(http.StatusOK)
+	defer active.Close()
+
+	v := newTestVaultCluster(t, down.URL, sealed.URL, active.URL)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+			t.Fatalf("RetrieveUser() failed: %v", err)
+		}
+	}
+	// the failed servers are not tried again before the health check interval
+	if sealed.count() != 1 || active.count() != 3 {
+		t.Errorf("Expected 1 request to the sealed and 3 to the active server, but received %d and %d", sealed.count(), active.count())
+	}
+
+	// the sealed server is checked again in the background once the
+	// interval elapsed
+	atomic.StoreInt64(&sealed.health, http.StatusOK)
+	v.probes.Wait()
+	for _, e := range v.vaultEndpoints {
+		e.mu.Lock()
+		e.checked = e.checked.Add(-time.Hour)
+		e.mu.Unlock()
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+			t.Fatalf("RetrieveUser() failed: %v", err)
+		}
+		v.probes.Wait()
+	}
+	if sealed.count() != 2 {
+		t.Errorf("Expected the unsealed server to be used, but received %d requests", sealed.count())
+	}
+
+	sealed.Close()
+	active.Close()
+	if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != ErrInternal {
+		t.Errorf("Expected ErrInternal when all servers are down, but received %v", err)
+	}
+}
+
+func TestVaultStandby(t *testing.T) {
+	standby := newFakeVaultNode(http.StatusTooManyRequests)
+	defer standby.Close()
+	active := newFakeVaultNode(http.StatusOK)
+	defer active.Close()
+
+	v := newTestVaultCluster(t, standby.URL, active.URL)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := v.RetrieveUser(ctx, "registry", "foo"); err != nil {
+			t.Fatalf("RetrieveUser() failed: %v", err)
+		}
+	}
+	if standby.count() != 1 || active.count() != 3 {
+		t.Errorf("Expected 1 request to the standby and 3 to the active server, but received %d and %d", standby.count(), active.count())
+	}
+	v.probes.Wait()
+	if state, _ := v.vaultEndpoints[0].status(); state != endpointStandby {
+		t.Errorf("Expected the first server to be a standby, but state is %d", state)
+	}
+}
+
+func TestVaultHungFailover(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hung.Close()
+	defer close(release)
+	active := newFakeVaultNode(http.StatusOK)
+	defer active.Close()
+
+	v := newTestVaultCluster(t, hung.URL, active.URL)
+	v.Config.Timeout = 200 * time.Millisecond
+	defer v.probes.Wait()
+
+	// the active server is tried once the hung one timed out, without
+	// waiting for its health check
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		start := time.Now()
+		_, err := v.RetrieveUser(ctx, "registry", "foo")
+		cancel()
+		if err != nil {
+			t.Fatalf("RetrieveUser() failed: %v", err)
+		}
+		if elapsed := time.Since(start); i > 0 && elapsed >= v.Config.Timeout {
+			t.Errorf("Expected the hung server to be skipped, but took %s", elapsed)
+		}
+	}
+	if active.count() != 3 {
+		t.Errorf("Expected 3 requests to the active server, but received %d", active.count())
+	}
+}
+
+func TestVaultRetry(t *testing.T) {
+	node := newFakeVaultNode(http.StatusOK)
+	defer node.Close()
+	atomic.StoreInt64(&node.failures, 2)
+
+	v := newTestVaultCluster(t, node.URL)
+	v.Config.Retries = 2
+	// the health check of the node succeeds
+	v.Config.HealthCheckInterval = 0
+
+	start := time.Now()
+	if _, err := v.RetrieveUser(context.Background(), "registry", "foo"); err != nil {
+		t.Fatalf("RetrieveUser() failed: %v", err)
+	}
+	if node.count() != 3 {
+		t.Errorf("Expected 3 requests, but received %d", node.count())
+	}
+	if elapsed := time.Since(start); elapsed < 3*vaultBackoff {
+		t.Errorf("Expected a backoff of %s between the retries, but took %s", 3*vaultBackoff, elapsed)
+	}
+
+	atomic.StoreInt64(&node.requests, 0)
+	atomic.StoreInt64(&node.failures, 10)
+	v.Config.Retries = 1
+	if _, err := v.RetrieveUser(context.Background(), "registry", "foo"); err != ErrInternal {
+		t.Errorf("Expected ErrInternal after the retries, but received %v", err)
+	}
+	if node.count() != 2 {
+		t.Errorf("Expected 2 requests, but received %d", node.count())
+	}
+}
+
+func TestVaultRetryCanceled(t *testing.T) {
+	node := newFakeVaultNode(http.StatusOK)
+	defer node.Close()
+	atomic.StoreInt64(&node.failures, 10)
+
+	v := newTestVaultCluster(t, node.URL)
+	v.Config.Retries = 2
+	v.Config.HealthCheckInterval = 0
+
+	// the context ends during the backoff, the failed response is not
+	// returned
+	ctx, cancel := context.WithTimeout(context.Background(), vaultBackoff/2)
+	defer cancel()
+	resp, err := v.do(ctx, "GET", "/v1/secret/registry/foo", "token", nil)
+	if resp != nil {
+		closeBody(resp)
+		t.Errorf("Expected no response, but received %s", resp.Status)
+	}
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, but received %v", context.DeadlineExceeded, err)
+	}
+	if node.count() != 1 {
+		t.Errorf("Expected 1 request, but received %d", node.count())
+	}
+}